@@ -0,0 +1,215 @@
+// lywsd03mmc-exporter - a Prometheus exporter for the LYWSD03MMC BLE thermometer
+
+// Copyright (C) 2020 Leah Neukirchen <leah@vuxu.org>
+// Licensed under the terms of the MIT license, see LICENSE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Threshold alerts, POSTed to -webhook-url.
+
+var webhookURL string
+var alertHysteresis = 1.0
+var alertCooldown = 15 * time.Minute
+
+// alertRule fires when quantity of mac (or any sensor if empty) is
+// above (or below) threshold.
+type alertRule struct {
+	mac       string
+	quantity  string
+	above     bool
+	threshold float64
+}
+
+func (r alertRule) String() string {
+	op := "<"
+	if r.above {
+		op = ">"
+	}
+	s := r.quantity + op + strconv.FormatFloat(r.threshold, 'f', -1, 64)
+	if r.mac != "" {
+		s = r.mac + "/" + s
+	}
+	return s
+}
+
+// violated reports whether value is beyond the threshold of r;
+// when the rule is already firing, value must come back by
+// alertHysteresis to count as cleared.
+func (r alertRule) violated(value float64, firing bool) bool {
+	margin := 0.0
+	if firing {
+		margin = alertHysteresis
+	}
+	if r.above {
+		return value > r.threshold-margin
+	}
+	return value < r.threshold+margin
+}
+
+type alertState struct {
+	firing bool
+	fired  time.Time
+}
+
+type alertKey struct {
+	rule alertRule
+	mac  string
+}
+
+var alertRules []alertRule
+var alerts = make(map[alertKey]*alertState)
+var alertsLock sync.Mutex
+
+// parseAlertRule parses [MAC/]QUANTITY<THRESHOLD or
+// [MAC/]QUANTITY>THRESHOLD.
+func parseAlertRule(s string) (alertRule, error) {
+	var r alertRule
+	s = strings.TrimSpace(s)
+	if i := strings.Index(s, "/"); i >= 0 {
+		r.mac = macWithoutColons(strings.TrimSpace(s[:i]))
+		s = s[i+1:]
+	}
+	i := strings.IndexAny(s, "<>")
+	if i < 0 {
+		return r, fmt.Errorf("expected QUANTITY<THRESHOLD or QUANTITY>THRESHOLD")
+	}
+	r.quantity = strings.TrimSpace(s[:i])
+	r.above = s[i] == '>'
+	switch r.quantity {
+	case "temperature", "humidity", "battery", "voltage":
+	default:
+		return r, fmt.Errorf("unknown quantity %q", r.quantity)
+	}
+	threshold, err := strconv.ParseFloat(strings.TrimSpace(s[i+1:]), 64)
+	if err != nil {
+		return r, err
+	}
+	r.threshold = threshold
+	return r, nil
+}
+
+type alertRuleFlag struct{}
+
+func (alertRuleFlag) String() string {
+	return ""
+}
+
+func (alertRuleFlag) Set(s string) error {
+	for _, rule := range strings.Split(s, ",") {
+		r, err := parseAlertRule(rule)
+		if err != nil {
+			return err
+		}
+		alertRules = append(alertRules, r)
+	}
+	return nil
+}
+
+// loadAlertRules reads one rule per line from filename, skipping
+// empty lines and comments.
+func loadAlertRules(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseAlertRule(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", filename, n, err)
+		}
+		alertRules = append(alertRules, r)
+	}
+	return scanner.Err()
+}
+
+type alertPayload struct {
+	MAC       string  `json:"mac"`
+	Name      string  `json:"name"`
+	Metric    string  `json:"metric"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+	Rule      string  `json:"rule"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+// checkAlerts evaluates the rules for a reading, and posts the ones
+// that start firing, unless they already fired within alertCooldown.
+func checkAlerts(mac, quantity string, value float64) {
+	now := time.Now()
+	var fire []alertRule
+
+	alertsLock.Lock()
+	for _, r := range alertRules {
+		if r.quantity != quantity || (r.mac != "" && r.mac != mac) {
+			continue
+		}
+		key := alertKey{r, mac}
+		st := alerts[key]
+		if st == nil {
+			st = &alertState{}
+			alerts[key] = st
+		}
+		violated := r.violated(value, st.firing)
+		if violated && !st.firing && now.Sub(st.fired) >= alertCooldown {
+			st.fired = now
+			fire = append(fire, r)
+		}
+		st.firing = violated
+	}
+	alertsLock.Unlock()
+
+	for _, r := range fire {
+		logger.Warn("alert", "mac", mac, "rule", r, "value", value)
+		go postAlert(alertPayload{
+			MAC:       mac,
+			Name:      sensorName(mac),
+			Metric:    quantity,
+			Value:     value,
+			Threshold: r.threshold,
+			Rule:      r.String(),
+			Timestamp: now.Unix(),
+		})
+	}
+}
+
+func postAlert(payload alertPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logger.Error("encoding alert failed", "err", err)
+		return
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Error("posting alert failed", "mac", payload.MAC, "err", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		logger.Error("posting alert failed", "mac", payload.MAC,
+			"err", fmt.Sprintf("%s: %s", resp.Status, bytes.TrimSpace(msg)))
+	}
+}
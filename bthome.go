@@ -0,0 +1,190 @@
+// lywsd03mmc-exporter - a Prometheus exporter for the LYWSD03MMC BLE thermometer
+
+// Copyright (C) 2020 Leah Neukirchen <leah@vuxu.org>
+// Licensed under the terms of the MIT license, see LICENSE.
+
+package main
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/go-ble/ble"
+
+	aesccm "github.com/pschlump/AesCCM"
+)
+
+// BTHome v2, see https://bthome.io/format/
+
+var BTHomeUUID = ble.UUID16(0xfcd2)
+
+// value sizes of the BTHome object IDs, -1 for a leading length byte
+var bthomeSizes = map[byte]int{
+	0x00: 1, 0x01: 1, 0x02: 2, 0x03: 2, 0x04: 3, 0x05: 3, 0x06: 2, 0x07: 2,
+	0x08: 2, 0x09: 1, 0x0a: 3, 0x0b: 3, 0x0c: 2, 0x0d: 2, 0x0e: 2, 0x0f: 1,
+	0x10: 1, 0x11: 1, 0x12: 2, 0x13: 2, 0x14: 2, 0x15: 1, 0x16: 1, 0x17: 1,
+	0x18: 1, 0x19: 1, 0x1a: 1, 0x1b: 1, 0x1c: 1, 0x1d: 1, 0x1e: 1, 0x1f: 1,
+	0x20: 1, 0x21: 1, 0x22: 1, 0x23: 1, 0x24: 1, 0x25: 1, 0x26: 1, 0x27: 1,
+	0x28: 1, 0x29: 1, 0x2a: 1, 0x2b: 1, 0x2c: 1, 0x2d: 1, 0x2e: 1, 0x2f: 1,
+	0x3a: 1, 0x3c: 2, 0x3d: 2, 0x3e: 4, 0x3f: 2, 0x40: 2, 0x41: 2, 0x42: 3,
+	0x43: 2, 0x44: 2, 0x45: 2, 0x46: 1, 0x47: 2, 0x48: 2, 0x49: 2, 0x4a: 2,
+	0x4b: 3, 0x4c: 4, 0x4d: 4, 0x4e: 4, 0x4f: 4, 0x50: 4, 0x51: 2, 0x52: 2,
+	0x53: -1, 0x54: -1, 0x55: 4, 0x56: 2, 0x57: 1, 0x58: 1, 0x59: 1, 0x5a: 2,
+	0x5b: 4, 0x5c: 4, 0x5d: 2, 0x5e: 2, 0x5f: 2, 0x60: 1, 0x61: 2,
+	0xf0: 2, 0xf1: 4, 0xf2: 3,
+}
+
+func decodeBTHomeV2Data(data []byte, frameMac string) (sensorData, error) {
+	if len(data) < 1 {
+		return sensorData{}, fmt.Errorf("empty BTHome frame")
+	}
+	if version := data[0] >> 5; version != 2 {
+		return sensorData{}, fmt.Errorf("unsupported BTHome version %d", version)
+	}
+	if data[0]&0x01 != 0 {
+		return decodeBTHomeV2Encrypted(data, frameMac)
+	}
+
+	return decodeBTHomeObjects(data[1:], frameMac)
+}
+
+var errNoKey = errors.New("no key")
+var errDecrypt = errors.New("couldn't decrypt")
+
+// decodeBTHomeV2Encrypted decrypts a BTHome frame consisting of the
+// device info byte, the encrypted objects, a 4 byte counter and a 4
+// byte MIC.
+func decodeBTHomeV2Encrypted(data []byte, frameMac string) (sensorData, error) {
+	if len(data) < 1+4+4 {
+		return sensorData{}, fmt.Errorf("short encrypted BTHome frame from %s", frameMac)
+	}
+
+	key, ok := decryptionKeys.Get(frameMac)
+	if !ok {
+		return sensorData{}, fmt.Errorf("%w for MAC %s, skipped", errNoKey, frameMac)
+	}
+
+	mac, err := hex.DecodeString(frameMac)
+	if err != nil {
+		return sensorData{}, err
+	}
+
+	ciphertext := []byte{}
+	ciphertext = append(ciphertext, data[1:len(data)-8]...) // payload
+	ciphertext = append(ciphertext, data[len(data)-4:]...)  // MIC
+
+	counter := data[len(data)-8 : len(data)-4]
+
+	nonce := []byte{}
+	nonce = append(nonce, mac...)     // MAC
+	nonce = append(nonce, 0xd2, 0xfc) // UUID
+	nonce = append(nonce, data[0])    // device info
+	nonce = append(nonce, counter...) // counter
+
+	aes, err := aes.NewCipher(key)
+	if err != nil {
+		return sensorData{}, fmt.Errorf("aes.NewCipher: %s", err)
+	}
+	ccm, err := aesccm.NewCCM(aes, 4, 13)
+	if err != nil {
+		return sensorData{}, fmt.Errorf("aesccm.NewCCM: %s", err)
+	}
+
+	dst, err := ccm.Open([]byte{}, nonce, ciphertext, nil)
+	if err != nil {
+		return sensorData{}, fmt.Errorf("%w BTHome frame from %s: %s", errDecrypt, frameMac, err)
+	}
+
+	sd, err := decodeBTHomeObjects(dst, frameMac)
+	if err != nil {
+		return sensorData{}, err
+	}
+	sd.frame = float64(binary.LittleEndian.Uint32(counter))
+	sd.bits = 32
+	sd.fields |= fieldFrame
+	return sd, nil
+}
+
+// decodeBTHomeObjects decodes the measurement objects of a BTHome frame.
+// Objects may appear in any order; when an object appears multiple
+// times (e.g. a second temperature probe), the first one is used.
+func decodeBTHomeObjects(data []byte, mac string) (sensorData, error) {
+	sd := sensorData{
+		mac:    mac,
+		format: "bthome",
+	}
+
+	for len(data) > 0 {
+		id := data[0]
+		size, ok := bthomeSizes[id]
+		if !ok {
+			return sensorData{}, fmt.Errorf("unknown BTHome object 0x%02x", id)
+		}
+		data = data[1:]
+		if size < 0 {
+			if len(data) < 1 {
+				return sensorData{}, fmt.Errorf("truncated BTHome object 0x%02x", id)
+			}
+			size = int(data[0])
+			data = data[1:]
+		}
+		if len(data) < size {
+			return sensorData{}, fmt.Errorf("truncated BTHome object 0x%02x", id)
+		}
+		v := data[:size]
+		data = data[size:]
+
+		switch id {
+		case 0x00: // packet id
+			if sd.fields&fieldFrame == 0 {
+				sd.frame = float64(v[0])
+				sd.fields |= fieldFrame
+			}
+		case 0x01: // battery, %
+			if sd.fields&fieldBatp == 0 {
+				sd.batp = float64(v[0])
+				sd.fields |= fieldBatp
+			}
+		case 0x15: // battery low
+			if sd.fields&fieldBatLow == 0 {
+				sd.batLow = v[0] != 0
+				sd.fields |= fieldBatLow
+			}
+		case 0x02, 0x45, 0x57: // temperature, 0.01°C, 0.1°C, 1°C
+			if sd.fields&fieldTemp == 0 {
+				switch id {
+				case 0x02:
+					sd.temp = float64(decodeSign(binary.LittleEndian.Uint16(v))) / 100.0
+				case 0x45:
+					sd.temp = float64(decodeSign(binary.LittleEndian.Uint16(v))) / 10.0
+				case 0x57:
+					sd.temp = float64(int8(v[0]))
+				}
+				sd.fields |= fieldTemp
+			}
+		case 0x03, 0x2e: // humidity, 0.01%, 1%
+			if sd.fields&fieldHum == 0 {
+				if id == 0x03 {
+					sd.hum = float64(binary.LittleEndian.Uint16(v)) / 100.0
+				} else {
+					sd.hum = float64(v[0])
+				}
+				sd.fields |= fieldHum
+			}
+		case 0x0c, 0x4a: // voltage, 0.001V, 0.1V
+			if sd.fields&fieldBatv == 0 {
+				if id == 0x0c {
+					sd.batv = float64(binary.LittleEndian.Uint16(v)) / 1000.0
+				} else {
+					sd.batv = float64(binary.LittleEndian.Uint16(v)) / 10.0
+				}
+				sd.fields |= fieldBatv
+			}
+		}
+	}
+
+	return sd, nil
+}
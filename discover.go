@@ -0,0 +1,171 @@
+// lywsd03mmc-exporter - a Prometheus exporter for the LYWSD03MMC BLE thermometer
+
+// Copyright (C) 2020 Leah Neukirchen <leah@vuxu.org>
+// Licensed under the terms of the MIT license, see LICENSE.
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-ble/ble"
+)
+
+type rawFrame struct {
+	uuid ble.UUID // nil for manufacturer data
+	data []byte
+}
+
+type discovered struct {
+	rssi   int
+	format string
+	values string
+}
+
+// discover scans for duration and prints a table of the devices seen,
+// with the readings decoded from their last frame.
+func discover(duration time.Duration, filter ble.AdvFilter) error {
+	found := make(map[string]*discovered)
+	var lock sync.Mutex
+
+	handler := func(a ble.Advertisement) {
+		mac := macWithoutColons(a.Addr().String())
+		dev := &discovered{rssi: a.RSSI(), format: "unknown"}
+
+		var frames []rawFrame
+		for _, sd := range a.ServiceData() {
+			frames = append(frames, rawFrame{sd.UUID, sd.Data})
+		}
+		if md := a.ManufacturerData(); md != nil {
+			frames = append(frames, rawFrame{nil, md})
+		}
+
+		for _, f := range frames {
+			d, _ := findDecoder(f.uuid, f.data)
+			if d == nil {
+				continue
+			}
+			dev.format = d.format
+			sd, err := d.decode(f.data, mac)
+			if errors.Is(err, errNoKey) {
+				dev.values = "no key"
+			} else if err != nil {
+				dev.values = err.Error()
+			} else {
+				dev.values = sd.describe()
+			}
+			break
+		}
+
+		lock.Lock()
+		if old, ok := found[mac]; !ok || old.format == "unknown" || dev.format != "unknown" {
+			found[mac] = dev
+		}
+		lock.Unlock()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+	err := ble.Scan(ctx, true, handler, filter)
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	var macs []string
+	for mac := range found {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "MAC\tRSSI\tFORMAT\tVALUES")
+	for _, mac := range macs {
+		dev := found[mac]
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", mac, dev.rssi, dev.format, dev.values)
+	}
+	return w.Flush()
+}
+
+// describe formats the readings of sd for humans.
+func (sd sensorData) describe() string {
+	var values []string
+	if sd.fields&fieldTemp != 0 {
+		values = append(values, fmt.Sprintf("%.2f°C", sd.temp))
+	}
+	if sd.fields&fieldHum != 0 {
+		values = append(values, fmt.Sprintf("%.1f%%", sd.hum))
+	}
+	if sd.fields&fieldBatp != 0 {
+		values = append(values, fmt.Sprintf("battery %.0f%%", sd.batp))
+	}
+	if sd.fields&fieldBatv != 0 {
+		values = append(values, fmt.Sprintf("%.3fV", sd.batv))
+	}
+	return strings.Join(values, " ")
+}
+
+// decryptFrame decodes the service data given as [UUID:]HEX (UUID
+// defaults to fe95, the MiBeacon frames of the stock firmware), as
+// sent by mac, and prints the readings.  When key is not empty, it is
+// used instead of the key file.
+func decryptFrame(mac, frame, key string) error {
+	mac = macWithoutColons(mac)
+	if len(mac) != 12 {
+		return fmt.Errorf("invalid MAC %q", mac)
+	}
+
+	uuid := XiaomiIncUUID
+	if i := strings.Index(frame, ":"); i == 4 {
+		u, err := ble.Parse(frame[:i])
+		if err != nil {
+			return fmt.Errorf("invalid UUID %q: %s", frame[:i], err)
+		}
+		uuid, frame = u, frame[i+1:]
+	}
+	frame = strings.TrimPrefix(strings.ToLower(frame), "0x")
+	frame = strings.NewReplacer(":", "", " ", "", "-", "").Replace(frame)
+	data, err := hex.DecodeString(frame)
+	if err != nil {
+		return fmt.Errorf("invalid frame: %s", err)
+	}
+
+	if key != "" {
+		k, err := hex.DecodeString(key)
+		if err != nil || len(k) != 16 {
+			return fmt.Errorf("invalid key %q: need 32 hex digits", key)
+		}
+		decryptionKeys.Set(map[string][]byte{mac: k})
+	}
+
+	d, known := findDecoder(uuid, data)
+	if d == nil {
+		if known {
+			return fmt.Errorf("no decoder for this frame of %s", uuid)
+		}
+		return fmt.Errorf("unknown UUID %s", uuid)
+	}
+	sd, err := d.decode(data, mac)
+	if err != nil {
+		return err
+	}
+
+	values := sd.describe()
+	if sd.fields&fieldNonce != 0 {
+		values += fmt.Sprintf(" counter %.0f", sd.nonce)
+	} else if sd.fields&fieldFrame != 0 {
+		values += fmt.Sprintf(" counter %.0f", sd.frame)
+	}
+	fmt.Printf("%s %s %s\n", mac, d.format, strings.TrimSpace(values))
+	return nil
+}
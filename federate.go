@@ -0,0 +1,147 @@
+// lywsd03mmc-exporter - a Prometheus exporter for the LYWSD03MMC BLE thermometer
+
+// Copyright (C) 2020 Leah Neukirchen <leah@vuxu.org>
+// Licensed under the terms of the MIT license, see LICENSE.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// a peer exporter whose metrics are re-exported with -federate
+type peer struct {
+	url      string
+	name     string // value of the peer label
+	families []*dto.MetricFamily
+	fetched  time.Time
+}
+
+var peers []*peer
+var peersLock sync.Mutex
+
+// set by -federate-interval and -federate-stale
+var federateInterval = 15 * time.Second
+var federateStale = 5 * time.Minute
+
+var federateClient = &http.Client{Timeout: 10 * time.Second}
+
+// addPeers adds the comma-separated peer URLs, which default to the
+// /metrics path.
+func addPeers(urls string) error {
+	for _, s := range strings.Split(urls, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		u, err := url.Parse(s)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid peer URL %q", s)
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/metrics"
+		}
+		peers = append(peers, &peer{url: u.String(), name: u.Host})
+	}
+	return nil
+}
+
+// fetchPeer fetches and parses the metrics of p, adding the peer label.
+func fetchPeer(p *peer) error {
+	resp, err := federateClient.Get(p.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	var parser expfmt.TextParser
+	parsed, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	label := "peer"
+	families := make([]*dto.MetricFamily, 0, len(parsed))
+	for _, mf := range parsed {
+		for _, m := range mf.Metric {
+			m.Label = append(m.Label, &dto.LabelPair{Name: &label, Value: &p.name})
+			sort.Slice(m.Label, func(i, j int) bool {
+				return m.Label[i].GetName() < m.Label[j].GetName()
+			})
+		}
+		families = append(families, mf)
+	}
+
+	peersLock.Lock()
+	p.families = families
+	p.fetched = time.Now()
+	peersLock.Unlock()
+	return nil
+}
+
+// runFederation fetches all peers every federateInterval until ctx is
+// done.
+func runFederation(ctx context.Context) {
+	for {
+		for _, p := range peers {
+			if err := fetchPeer(p); err != nil {
+				logger.Error("fetching peer failed", "url", p.url, "err", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(federateInterval):
+		}
+	}
+}
+
+// federation gathers the last metrics of all peers fetched within
+// federateStale.
+type federation struct{}
+
+func (federation) Gather() ([]*dto.MetricFamily, error) {
+	merged := make(map[string]*dto.MetricFamily)
+
+	peersLock.Lock()
+	for _, p := range peers {
+		if time.Since(p.fetched) > federateStale {
+			continue
+		}
+		for _, mf := range p.families {
+			if m, ok := merged[mf.GetName()]; ok {
+				m.Metric = append(m.Metric, mf.Metric...)
+				continue
+			}
+			merged[mf.GetName()] = &dto.MetricFamily{
+				Name:   mf.Name,
+				Help:   mf.Help,
+				Type:   mf.Type,
+				Metric: append([]*dto.Metric{}, mf.Metric...),
+			}
+		}
+	}
+	peersLock.Unlock()
+
+	families := make([]*dto.MetricFamily, 0, len(merged))
+	for _, mf := range merged {
+		families = append(families, mf)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].GetName() < families[j].GetName()
+	})
+	return families, nil
+}
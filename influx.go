@@ -0,0 +1,192 @@
+// lywsd03mmc-exporter - a Prometheus exporter for the LYWSD03MMC BLE thermometer
+
+// Copyright (C) 2020 Leah Neukirchen <leah@vuxu.org>
+// Licensed under the terms of the MIT license, see LICENSE.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InfluxDB line protocol output, see
+// https://docs.influxdata.com/influxdb/v2/reference/syntax/line-protocol/
+
+var influxURL string
+var influxToken string
+var influxOrg string
+var influxDB = "thermometer"
+var influxInterval = 10 * time.Second
+
+// drop the oldest points when the server is unreachable for long
+const influxMaxPoints = 10000
+
+// UDP datagrams are kept below a typical MTU
+const influxMaxDatagram = 1400
+
+var influxPoints []string
+var influxLock sync.Mutex
+
+// fields of the reading being recorded, per MAC
+var influxFields = make(map[string]map[string]float64)
+
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// the fields of a point, in this order
+var influxQuantities = []string{"temperature", "humidity", "battery", "voltage"}
+
+// influxRecord adds a field to the point of mac, which is written by
+// influxPoint once the whole reading is recorded.
+func influxRecord(mac, quantity string, value float64) {
+	influxLock.Lock()
+	if influxFields[mac] == nil {
+		influxFields[mac] = make(map[string]float64)
+	}
+	influxFields[mac][quantity] = value
+	influxLock.Unlock()
+}
+
+// influxPoint queues the fields recorded for mac as one point.
+func influxPoint(mac string) {
+	influxLock.Lock()
+	fields := influxFields[mac]
+	delete(influxFields, mac)
+	influxLock.Unlock()
+	if len(fields) == 0 {
+		return
+	}
+
+	var values []string
+	for _, quantity := range influxQuantities {
+		if v, ok := fields[quantity]; ok {
+			values = append(values, quantity+"="+strconv.FormatFloat(v, 'f', -1, 64))
+		}
+	}
+	line := fmt.Sprintf("thermometer,mac=%s,sensor=%s,name=%s %s %d",
+		influxTagEscaper.Replace(mac),
+		influxTagEscaper.Replace(sensorModel(mac)),
+		influxTagEscaper.Replace(sensorName(mac)),
+		strings.Join(values, ","),
+		time.Now().UnixNano())
+
+	influxLock.Lock()
+	influxPoints = append(influxPoints, line)
+	if n := len(influxPoints); n > influxMaxPoints {
+		influxPoints = influxPoints[n-influxMaxPoints:]
+	}
+	influxLock.Unlock()
+}
+
+// influxWriteURL returns the v2 write endpoint when a token is
+// given, else the v1 one.
+func influxWriteURL() string {
+	q := url.Values{}
+	endpoint := "/write"
+	if influxToken != "" {
+		endpoint = "/api/v2/write"
+		q.Set("org", influxOrg)
+		q.Set("bucket", influxDB)
+	} else {
+		q.Set("db", influxDB)
+	}
+	return strings.TrimSuffix(influxURL, "/") + endpoint + "?" + q.Encode()
+}
+
+func flushInflux() {
+	influxLock.Lock()
+	points := influxPoints
+	influxPoints = nil
+	influxLock.Unlock()
+	if len(points) == 0 {
+		return
+	}
+
+	var err error
+	if strings.HasPrefix(influxURL, "udp://") {
+		err = writeInfluxUDP(points)
+	} else {
+		err = writeInflux(strings.Join(points, "\n") + "\n")
+	}
+	if err != nil {
+		logger.Error("writing to InfluxDB failed", "err", err)
+		// retry with the next flush
+		influxLock.Lock()
+		influxPoints = append(points, influxPoints...)
+		if n := len(influxPoints); n > influxMaxPoints {
+			influxPoints = influxPoints[n-influxMaxPoints:]
+		}
+		influxLock.Unlock()
+	}
+}
+
+func writeInflux(body string) error {
+	req, err := http.NewRequest("POST", influxWriteURL(), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if influxToken != "" {
+		req.Header.Set("Authorization", "Token "+influxToken)
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// writeInfluxUDP sends points to the UDP service of InfluxDB 1.x, as
+// many per datagram as fit.
+func writeInfluxUDP(points []string) error {
+	conn, err := net.Dial("udp", strings.TrimPrefix(influxURL, "udp://"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var buf []byte
+	for i, point := range points {
+		buf = append(buf, point...)
+		buf = append(buf, '\n')
+		if i == len(points)-1 || len(buf)+len(points[i+1])+1 > influxMaxDatagram {
+			if _, err := conn.Write(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+	}
+	return nil
+}
+
+// runInflux flushes the collected points every influxInterval, and a
+// last time when ctx is done.
+func runInflux(ctx context.Context) {
+	ticker := time.NewTicker(influxInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushInflux()
+			return
+		case <-ticker.C:
+			flushInflux()
+		}
+	}
+}
@@ -8,21 +8,36 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/go-ble/ble"
 	"github.com/go-ble/ble/examples/lib/dev"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
@@ -31,76 +46,591 @@ import (
 	aesccm "github.com/pschlump/AesCCM"
 )
 
+// labels of the per-sensor metrics
+var sensorLabels = []string{
+	"sensor",
+	"mac",
+	"name",
+}
+
 var (
-	tempGauge = promauto.NewGaugeVec(
+	tempGauge           *prometheus.GaugeVec
+	tempHistogram       *prometheus.HistogramVec
+	tempTrendGauge      *prometheus.GaugeVec
+	intervalGauge       *prometheus.GaugeVec
+	fahrenheitGauge     *prometheus.GaugeVec
+	humGauge            *prometheus.GaugeVec
+	milliTempGauge      *prometheus.GaugeVec
+	milliHumGauge       *prometheus.GaugeVec
+	rawTempGauge        *prometheus.GaugeVec
+	rawHumGauge         *prometheus.GaugeVec
+	dewPointGauge       *prometheus.GaugeVec
+	condensationGauge   *prometheus.GaugeVec
+	absHumGauge         *prometheus.GaugeVec
+	battGauge           *prometheus.GaugeVec
+	battLowGauge        *prometheus.GaugeVec
+	voltGauge           *prometheus.GaugeVec
+	battDaysGauge       *prometheus.GaugeVec
+	frameGauge          *prometheus.GaugeVec
+	nonceGauge          *prometheus.GaugeVec
+	onboardMinGauge     *prometheus.GaugeVec
+	onboardMaxGauge     *prometheus.GaugeVec
+	triggerGauge        *prometheus.GaugeVec
+	reedGauge           *prometheus.GaugeVec
+	lastSeenGauge       *prometheus.GaugeVec
+	upGauge             *prometheus.GaugeVec
+	infoGauge           *prometheus.GaugeVec
+	rssiGauge           *prometheus.GaugeVec
+	framesCounter       *prometheus.CounterVec
+	decodeErrorsCounter *prometheus.CounterVec
+	framesMissedCounter *prometheus.CounterVec
+	advDuration         prometheus.Histogram
+	panicsCounter       prometheus.Counter
+	activeSensors       prometheus.GaugeFunc
+	scrapeDuration      *prometheus.HistogramVec
+	rejectedCounter     *prometheus.CounterVec
+	connectedGauge      *prometheus.GaugeVec
+	pollErrorsCounter   *prometheus.CounterVec
+	pollSuccessGauge    *prometheus.GaugeVec
+	scanRestarts        prometheus.Counter
+)
+
+// the namespace passed to initMetrics
+var metricsNamespace string
+
+// registry holds all metrics served on /metrics and pushed
+var registry = prometheus.NewRegistry()
+
+// initMetrics creates the metrics and registers them with reg, using
+// namespace for the metrics of the sensors.
+func initMetrics(reg prometheus.Registerer, namespace string) {
+	metricsNamespace = namespace
+	f := promauto.With(reg)
+
+	tempGauge = f.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: "thermometer",
+			Namespace: namespace,
 			Name:      "temperature_celsius",
 			Help:      "Temperature in Celsius.",
 		},
-		[]string{
-			"sensor",
-			"mac",
+		sensorLabels,
+	)
+
+	intervalGauge = f.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "advertising_interval_seconds",
+			Help:      "Smoothed interval between the advertisements of the sensor.",
+		},
+		sensorLabels,
+	)
+
+	tempTrendGauge = f.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "temperature_celsius_per_hour",
+			Help:      "Smoothed rate of change of the temperature.",
+		},
+		sensorLabels,
+	)
+
+	tempHistogram = f.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "temperature_celsius_histogram",
+			Help:      "Distribution of the temperature readings in Celsius.",
+			Buckets:   prometheus.LinearBuckets(-20, 5, 15),
+		},
+		sensorLabels,
+	)
+
+	fahrenheitGauge = f.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "temperature_fahrenheit",
+			Help:      "Temperature in Fahrenheit.",
 		},
+		sensorLabels,
 	)
-	humGauge = promauto.NewGaugeVec(
+
+	humGauge = f.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: "thermometer",
+			Namespace: namespace,
 			Name:      "humidity_ratio",
 			Help:      "Humidity in percent.",
 		},
-		[]string{
-			"sensor",
-			"mac",
+		sensorLabels,
+	)
+
+	milliTempGauge = f.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "temperature_millicelsius",
+			Help:      "Temperature in millidegrees Celsius.",
+		},
+		sensorLabels,
+	)
+
+	milliHumGauge = f.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "humidity_millipercent",
+			Help:      "Humidity in thousandths of a percent.",
+		},
+		sensorLabels,
+	)
+
+	rawTempGauge = f.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "temperature_raw_celsius",
+			Help:      "Temperature in Celsius, before smoothing.",
+		},
+		sensorLabels,
+	)
+
+	rawHumGauge = f.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "humidity_raw_ratio",
+			Help:      "Humidity in percent, before smoothing.",
+		},
+		sensorLabels,
+	)
+
+	dewPointGauge = f.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "dewpoint_celsius",
+			Help:      "Dew point in Celsius.",
+		},
+		sensorLabels,
+	)
+
+	condensationGauge = f.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "condensation_risk",
+			Help:      "Whether the dew point is within the condensation margin of the temperature.",
+		},
+		sensorLabels,
+	)
+
+	absHumGauge = f.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "absolute_humidity_grams_per_cubic_meter",
+			Help:      "Absolute humidity in g/m³.",
 		},
+		sensorLabels,
 	)
-	battGauge = promauto.NewGaugeVec(
+
+	battGauge = f.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: "thermometer",
+			Namespace: namespace,
 			Name:      "battery_ratio",
 			Help:      "Battery in percent.",
 		},
-		[]string{
-			"sensor",
-			"mac",
+		sensorLabels,
+	)
+
+	battLowGauge = f.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "battery_low",
+			Help:      "Whether the battery is low.",
 		},
+		sensorLabels,
 	)
-	voltGauge = promauto.NewGaugeVec(
+
+	voltGauge = f.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: "thermometer",
+			Namespace: namespace,
 			Name:      "battery_volts",
 			Help:      "Battery in Volt.",
 		},
-		[]string{
-			"sensor",
-			"mac",
+		sensorLabels,
+	)
+
+	battDaysGauge = f.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "battery_days_remaining",
+			Help:      "Estimated days until the battery is empty.",
 		},
+		sensorLabels,
 	)
-	frameGauge = promauto.NewGaugeVec(
+
+	frameGauge = f.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: "thermometer",
+			Namespace: namespace,
 			Name:      "frame_current",
 			Help:      "Current frame number.",
 		},
+		sensorLabels,
+	)
+
+	nonceGauge = f.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "nonce_counter",
+			Help:      "Counter of the last encrypted frame.",
+		},
+		sensorLabels,
+	)
+
+	onboardMinGauge = f.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "onboard_min_celsius",
+			Help:      "Minimum temperature of the last onboard record.",
+		},
+		sensorLabels,
+	)
+
+	onboardMaxGauge = f.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "onboard_max_celsius",
+			Help:      "Maximum temperature of the last onboard record.",
+		},
+		sensorLabels,
+	)
+
+	triggerGauge = f.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "trigger_state",
+			Help:      "State of the GPIO trigger output.",
+		},
+		sensorLabels,
+	)
+
+	reedGauge = f.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "reed_switch",
+			Help:      "State of the reed switch input.",
+		},
+		sensorLabels,
+	)
+
+	lastSeenGauge = f.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_seen_timestamp_seconds",
+			Help:      "Time of the last reading.",
+		},
+		sensorLabels,
+	)
+
+	upGauge = f.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "up",
+			Help:      "Whether the sensor has been seen within its expiry time.",
+		},
+		sensorLabels,
+	)
+
+	infoGauge = f.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "sensor_info",
+			Help:      "Static attributes of a sensor.",
+		},
 		[]string{
-			"sensor",
 			"mac",
+			"name",
+			"firmware",
+			"adv_name",
+			"model",
+			"embedded_mac",
+			"device_name",
+			"firmware_revision",
 		},
 	)
-	rssiGauge = promauto.NewGaugeVec(
+
+	rssiGauge = f.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: "thermometer",
+			Namespace: namespace,
 			Name:      "rssi_dbm",
 			Help:      "Received Signal Strength Indication.",
 		},
 		[]string{
 			"sensor",
 			"mac",
+			"name",
+			"adapter",
+		},
+	)
+
+	framesCounter = f.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "frames_received_total",
+			Help:      "Number of frames received.",
+		},
+		[]string{
+			"mac",
+			"format",
+		},
+	)
+
+	decodeErrorsCounter = f.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "decode_errors_total",
+			Help:      "Number of frames that failed to decode.",
+		},
+		[]string{
+			"mac",
+			"reason",
+		},
+	)
+
+	framesMissedCounter = f.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "frames_missed_total",
+			Help:      "Number of frames missed, from gaps in the frame counter.",
+		},
+		[]string{
+			"mac",
+		},
+	)
+
+	advDuration = f.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "exporter_adv_handler_duration_seconds",
+			Help:    "Time spent handling an advertisement.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 8),
+		},
+	)
+
+	panicsCounter = f.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "panics_total",
+			Help:      "Number of advertisements whose handling panicked.",
+		},
+	)
+
+	activeSensors = f.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_sensors",
+			Help:      "Number of sensors currently reporting.",
+		},
+		func() float64 {
+			expirersLock.Lock()
+			defer expirersLock.Unlock()
+			return float64(len(expirers) - len(down))
+		},
+	)
+
+	scrapeDuration = f.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "exporter_scrape_duration_seconds",
+			Help:    "Time spent serving /metrics.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 6),
+		},
+		[]string{"code"},
+	)
+
+	rejectedCounter = f.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rejected_readings_total",
+			Help:      "Number of readings rejected as physically impossible.",
+		},
+		[]string{
+			"mac",
+			"quantity",
+		},
+	)
+
+	connectedGauge = f.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "connected",
+			Help:      "Whether the polled sensor is currently connected.",
+		},
+		sensorLabels,
+	)
+
+	pollErrorsCounter = f.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "poll_errors_total",
+			Help:      "Number of failed operations on polled sensors.",
+		},
+		[]string{
+			"mac",
+			"operation",
+		},
+	)
+
+	pollSuccessGauge = f.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "poll_last_success_timestamp_seconds",
+			Help:      "Time of the last successful subscribe or read on the polled sensor.",
+		},
+		sensorLabels,
+	)
+
+	scanRestarts = f.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scan_restarts_total",
+			Help:      "Number of times scanning was restarted after an error.",
 		},
 	)
+}
+
+var errMacMismatch = errors.New("MAC mismatch")
+
+// decodeError counts and logs err for a frame from mac.
+func decodeError(mac string, err error) {
+	reason := "decode"
+	if errors.Is(err, errMacMismatch) {
+		reason = "mac_mismatch"
+	} else if errors.Is(err, errNoKey) {
+		reason = "no_key"
+	} else if errors.Is(err, errDecrypt) {
+		reason = "decrypt"
+	} else if errors.Is(err, errLength) {
+		reason = "length"
+	}
+	decodeErrorsCounter.WithLabelValues(mac, reason).Inc()
+	logger.Error("decoding failed", "mac", mac, "reason", reason, "err", err)
+}
+
+// set at build time with -ldflags "-X main.version=... -X main.commit=..."
+var version = "dev"
+var commit = ""
+
+// registerBuildInfo registers the metrics describing the exporter
+// itself.
+func registerBuildInfo(reg prometheus.Registerer, namespace string) {
+	buildInfo := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exporter_build_info",
+			Help:      "Build information of the exporter, always 1.",
+			ConstLabels: prometheus.Labels{
+				"version":   version,
+				"commit":    commit,
+				"goversion": runtime.Version(),
+			},
+		},
+	)
+	buildInfo.Set(1)
+
+	start := time.Now()
+	uptime := prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "exporter_uptime_seconds",
+			Help:      "Seconds since the exporter started.",
+		},
+		func() float64 { return time.Since(start).Seconds() },
+	)
+
+	reg.MustRegister(buildInfo, uptime)
+}
+
+// readyGauge is only registered with -ready-gate
+var readyGauge = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "exporter_ready",
+		Help: "Whether any sensor has been decoded yet.",
+	},
 )
 
+var ready int32
+
+func setReady() {
+	if atomic.CompareAndSwapInt32(&ready, 0, 1) {
+		readyGauge.Set(1)
+	}
+}
+
+// scanning is the number of adapters currently scanning
+var scanning int32
+
+// noScan disables Bluetooth, set by -no-scan
+var noScan bool
+
+// lastBump is the time any sensor was last seen, in Unix nanoseconds
+var lastBump int64
+
+// with readyWindow, /readyz also requires a sensor seen within it
+var readyWindow time.Duration
+
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// serveReadyz reports whether scanning is running and, with
+// readyWindow, whether a sensor was seen recently.
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if !noScan && atomic.LoadInt32(&scanning) == 0 {
+		http.Error(w, "not scanning", http.StatusServiceUnavailable)
+		return
+	}
+	if readyWindow > 0 {
+		last := time.Unix(0, atomic.LoadInt64(&lastBump))
+		if time.Since(last) > readyWindow {
+			http.Error(w, "no sensor seen recently", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// gateReady serves notReady until the first sensor has been decoded.
+func gateReady(h, notReady http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&ready) == 0 {
+			notReady.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 const Sensor = "LYWSD03MMC"
+
+// friendly names of sensors, from the keyfile
+var names = make(map[string]string)
+
+// sensorName returns the friendly name of mac, or mac itself.
+func sensorName(mac string) string {
+	keysLock.RLock()
+	defer keysLock.RUnlock()
+	if name, ok := names[mac]; ok {
+		return name
+	}
+	return mac
+}
+
+// sensorModel returns the model of mac, the sensor label of its
+// metrics.
+func sensorModel(mac string) string {
+	statesLock.Lock()
+	defer statesLock.Unlock()
+	if st, ok := states[mac]; ok && st.info.model != "" {
+		return st.info.model
+	}
+	return Sensor
+}
+
+func labelValues(mac string) []string {
+	return []string{sensorModel(mac), mac, sensorName(mac)}
+}
+
 const TelinkVendorPrefix = "a4:c1:38"
 
 var EnvironmentalSensingUUID = ble.UUID16(0x181a)
@@ -110,417 +640,2855 @@ const ExpiryAtc = 2.5 * 10 * time.Second
 const ExpiryStock = 2.5 * 10 * time.Minute
 const ExpiryConn = 2.5 * 10 * time.Second
 
+// expiry durations, set by -expiry-adv, -expiry-stock, -expiry-conn
+var expiryAdv = ExpiryAtc
+var expiryStock = ExpiryStock
+var expiryConn = ExpiryConn
+
 var expirers = make(map[string]*time.Timer)
 var expirersLock sync.Mutex
 
+// sensors past their expiry whose metrics are kept for expiryGrace,
+// protected by expirersLock
+var down = make(map[string]bool)
+
+// set by -expiry-grace
+var expiryGrace time.Duration
+
+// with expiryMultiplier, sensors expire after that many of their
+// observed advertising intervals, bounded by expiryMin and expiryMax
+var expiryMultiplier float64
+var expiryMin = 10 * time.Second
+var expiryMax = 1 * time.Hour
+
+// observeInterval updates and exports the smoothed interval between
+// the accepted advertisements of mac.
+func observeInterval(mac string) {
+	now := time.Now()
+
+	statesLock.Lock()
+	st := sensor(mac)
+	if !st.lastHeard.IsZero() {
+		d := now.Sub(st.lastHeard)
+		if st.interval == 0 {
+			st.interval = d
+		} else {
+			st.interval = (3*st.interval + d) / 4
+		}
+	}
+	st.lastHeard = now
+	interval := st.interval
+	statesLock.Unlock()
+
+	if interval > 0 {
+		intervalGauge.WithLabelValues(labelValues(mac)...).Set(interval.Seconds())
+	}
+}
+
+// noExpiry keeps all sensors forever, set for -replay
+var noExpiry bool
+
 func bump(mac string, expiry time.Duration) {
+	setReady()
+	atomic.StoreInt64(&lastBump, time.Now().UnixNano())
+	lastSeenGauge.WithLabelValues(labelValues(mac)...).Set(float64(time.Now().Unix()))
+
+	statesLock.Lock()
+	st := sensor(mac)
+	st.lastSeen = time.Now()
+	interval := st.interval
+	statesLock.Unlock()
+
+	if expiryMultiplier > 0 && interval > 0 {
+		expiry = time.Duration(expiryMultiplier * float64(interval))
+		if expiry < expiryMin {
+			expiry = expiryMin
+		}
+		if expiry > expiryMax {
+			expiry = expiryMax
+		}
+	}
+
+	labels := labelValues(mac)
 	expirersLock.Lock()
+	upGauge.WithLabelValues(labels...).Set(1)
+	delete(down, mac)
 	if t, ok := expirers[mac]; ok {
-		t.Reset(expiry)
+		if !noExpiry {
+			t.Reset(expiry)
+		}
 	} else {
-		expirers[mac] = time.AfterFunc(expiry, func() {
-			fmt.Printf("expiring %s\n", mac)
-			tempGauge.DeleteLabelValues(Sensor, mac)
-			humGauge.DeleteLabelValues(Sensor, mac)
-			battGauge.DeleteLabelValues(Sensor, mac)
-			voltGauge.DeleteLabelValues(Sensor, mac)
-			frameGauge.DeleteLabelValues(Sensor, mac)
-			rssiGauge.DeleteLabelValues(Sensor, mac)
-
-			expirersLock.Lock()
-			delete(expirers, mac)
-			expirersLock.Unlock()
+		t := time.AfterFunc(expiry, func() {
+			lapse(mac)
 		})
+		if noExpiry {
+			t.Stop()
+		}
+		expirers[mac] = t
 	}
 	expirersLock.Unlock()
 }
 
-func macWithColons(mac string) string {
-	return strings.ToUpper(fmt.Sprintf("%s:%s:%s:%s:%s:%s",
-		mac[0:2],
-		mac[2:4],
-		mac[4:6],
-		mac[6:8],
-		mac[8:10],
-		mac[10:12]))
+// lapse is called when mac hasn't been seen within its expiry time.
+// With expiryGrace, thermometer_up drops to 0 and the metrics are kept
+// for that long before they are deleted.
+func lapse(mac string) {
+	labels := labelValues(mac)
+	expirersLock.Lock()
+	t, ok := expirers[mac]
+	if ok && expiryGrace > 0 && !down[mac] {
+		logger.Info("sensor down", "mac", mac)
+		upGauge.WithLabelValues(labels...).Set(0)
+		down[mac] = true
+		t.Reset(expiryGrace)
+		expirersLock.Unlock()
+		return
+	}
+	expirersLock.Unlock()
+
+	if ok {
+		expire(mac)
+	}
 }
 
-func macWithoutColons(mac string) string {
-	return strings.ReplaceAll(strings.ToUpper(mac), ":", "")
+// expire deletes all metrics and state of mac.
+func expire(mac string) {
+	logger.Info("expiring", "mac", mac)
+	labels := labelValues(mac)
+	tempGauge.DeleteLabelValues(labels...)
+	tempHistogram.DeleteLabelValues(labels...)
+	tempTrendGauge.DeleteLabelValues(labels...)
+	intervalGauge.DeleteLabelValues(labels...)
+	fahrenheitGauge.DeleteLabelValues(labels...)
+	humGauge.DeleteLabelValues(labels...)
+	milliTempGauge.DeleteLabelValues(labels...)
+	milliHumGauge.DeleteLabelValues(labels...)
+	rawTempGauge.DeleteLabelValues(labels...)
+	rawHumGauge.DeleteLabelValues(labels...)
+	dewPointGauge.DeleteLabelValues(labels...)
+	condensationGauge.DeleteLabelValues(labels...)
+	absHumGauge.DeleteLabelValues(labels...)
+	battGauge.DeleteLabelValues(labels...)
+	battLowGauge.DeleteLabelValues(labels...)
+	voltGauge.DeleteLabelValues(labels...)
+	battDaysGauge.DeleteLabelValues(labels...)
+	frameGauge.DeleteLabelValues(labels...)
+	nonceGauge.DeleteLabelValues(labels...)
+	onboardMinGauge.DeleteLabelValues(labels...)
+	onboardMaxGauge.DeleteLabelValues(labels...)
+	triggerGauge.DeleteLabelValues(labels...)
+	reedGauge.DeleteLabelValues(labels...)
+	lastSeenGauge.DeleteLabelValues(labels...)
+	upGauge.DeleteLabelValues(labels...)
+	connectedGauge.DeleteLabelValues(labels...)
+	pollSuccessGauge.DeleteLabelValues(labels...)
+	framesMissedCounter.DeleteLabelValues(mac)
+	for _, op := range pollOperations {
+		pollErrorsCounter.DeleteLabelValues(mac, op)
+	}
+
+	statesLock.Lock()
+	if st, ok := states[mac]; ok {
+		for a := range st.adapters {
+			rssiGauge.DeleteLabelValues(append(labels, a)...)
+		}
+		if st.infoSet {
+			infoGauge.DeleteLabelValues(st.info.labels(mac)...)
+		}
+	}
+	delete(states, mac)
+	statesLock.Unlock()
+
+	expirersLock.Lock()
+	delete(expirers, mac)
+	delete(down, mac)
+	expirersLock.Unlock()
+
+	if mqttClient != nil {
+		mqttExpire(mac)
+	}
+}
+
+// forget expires mac right away, if it is known.
+func forget(mac string) {
+	expirersLock.Lock()
+	t, ok := expirers[mac]
+	expirersLock.Unlock()
+	if ok && (t.Stop() || noExpiry) {
+		expire(mac)
+	}
+}
+
+// sensorState keeps the last exported values of a sensor.
+type sensorState struct {
+	temp    float64
+	hum     float64
+	hasTemp bool
+	hasHum  bool
+
+	trendTemp float64 // last temperature for the trend
+	trendTime time.Time
+	trend     float64 // °C per hour
+	hasTrend  bool
+
+	recentTemp []float64 // last medianWindow readings
+	recentHum  []float64
+
+	avgTemp    float64 // smoothed with smoothAlpha
+	avgHum     float64
+	hasAvgTemp bool
+	hasAvgHum  bool
+
+	info    sensorInfo
+	infoSet bool
+
+	adapters map[string]bool // which adapters have seen this sensor
+	rssi     int             // of the last frame on bestAdapter
+	hasRSSI  bool
+
+	bestAdapter string // adapter whose readings are used
+	bestSeen    time.Time
+
+	lastSeen  time.Time
+	lastHeard time.Time // last accepted advertisement, for the interval
+	interval  time.Duration
+
+	frame     float64 // counter of the last frame
+	frameBits int
+	hasFrame  bool
+
+	volts []voltSample
+
+	hasBatLow bool // the sensor reports battery low itself
+
+	readings map[string]float64 // last value per quantity
+}
+
+var states = make(map[string]*sensorState)
+var statesLock sync.Mutex
+
+// sensor returns the state for mac, statesLock must be held.
+func sensor(mac string) *sensorState {
+	st, ok := states[mac]
+	if !ok {
+		st = &sensorState{
+			adapters: make(map[string]bool),
+			readings: make(map[string]float64),
+		}
+		states[mac] = st
+	}
+	return st
+}
+
+// exportHistogram also observes temperatures in tempHistogram
+var exportHistogram bool
+
+// exportFahrenheit also exports temperature in Fahrenheit
+var exportFahrenheit bool
+
+// exportMilli also exports temperature and humidity as integers
+var exportMilli bool
+
+// a sensor sticks to the adapter hearing it best for this long, unless
+// another one hears it better
+const adapterWindow = 30 * time.Second
+
+// setRSSI exports the RSSI of a frame from mac received on adapter, and
+// reports whether adapter is the one hearing mac best, whose readings
+// are used.
+func setRSSI(mac string, adapter string, rssi int) bool {
+	now := time.Now()
+
+	statesLock.Lock()
+	st := sensor(mac)
+	st.adapters[adapter] = true
+	best := st.bestAdapter == "" || st.bestAdapter == adapter ||
+		now.Sub(st.bestSeen) > adapterWindow || rssi > st.rssi
+	if best {
+		if st.bestAdapter != "" && st.bestAdapter != adapter {
+			logger.Debug("switched adapter", "mac", mac, "from", st.bestAdapter, "adapter", adapter, "rssi", rssi)
+		}
+		st.bestAdapter = adapter
+		st.bestSeen = now
+		st.rssi = rssi
+		st.hasRSSI = true
+	}
+	statesLock.Unlock()
+
+	rssiGauge.WithLabelValues(append(labelValues(mac), adapter)...).Set(float64(rssi))
+	return best
+}
+
+// sensorInfo are the labels of thermometer_sensor_info.
+type sensorInfo struct {
+	name        string
+	firmware    string
+	advName     string
+	model       string
+	embeddedMac string
+	deviceInfo
+}
+
+func (i sensorInfo) labels(mac string) []string {
+	return []string{mac, i.name, i.firmware, i.advName, i.model, i.embeddedMac,
+		i.deviceName, i.revision}
+}
+
+// deviceInfo is read from the GATT characteristics of polled sensors.
+type deviceInfo struct {
+	deviceName string
+	revision   string
+}
+
+// deviceInfos caches the deviceInfo per MAC, so it's only read on the
+// first connection.
+var deviceInfos = make(map[string]deviceInfo)
+var deviceInfosLock sync.Mutex
+
+func lookupDeviceInfo(mac string) (deviceInfo, bool) {
+	deviceInfosLock.Lock()
+	defer deviceInfosLock.Unlock()
+	di, ok := deviceInfos[mac]
+	return di, ok
+}
+
+func setDeviceInfo(mac string, di deviceInfo) {
+	deviceInfosLock.Lock()
+	deviceInfos[mac] = di
+	deviceInfosLock.Unlock()
+	updateInfo(mac, func(*sensorInfo) {})
+}
+
+// exportEmbeddedMac sets embedded_mac to the MAC decoded from the payload
+var exportEmbeddedMac bool
+
+// updateInfo applies f to the info of mac and exports it if it changed.
+func updateInfo(mac string, f func(*sensorInfo)) {
+	statesLock.Lock()
+	defer statesLock.Unlock()
+
+	st := sensor(mac)
+	old := st.info
+	f(&st.info)
+	st.info.name = sensorName(mac)
+	st.info.deviceInfo, _ = lookupDeviceInfo(mac)
+	if st.infoSet {
+		if st.info == old {
+			return
+		}
+		infoGauge.DeleteLabelValues(old.labels(mac)...)
+	}
+	infoGauge.WithLabelValues(st.info.labels(mac)...).Set(1)
+	st.infoSet = true
+}
+
+// setFirmware records the format and model of a frame from mac, and
+// the MAC bytes embedded in its payload, if any.
+func setFirmware(mac string, format string, model string, embeddedMac string) {
+	updateInfo(mac, func(i *sensorInfo) {
+		if exportEmbeddedMac {
+			i.embeddedMac = embeddedMac
+		}
+		if i.firmware != "" && i.firmware != format {
+			logger.Info("switched format", "mac", mac, "from", i.firmware, "format", format)
+		}
+		i.firmware = format
+		i.model = model
+	})
+}
+
+var tempDeadband float64
+var humDeadband float64
+
+// inDeadband reports whether v is within deadband of the last value,
+// and else records v as the new last value.
+func inDeadband(v float64, last *float64, has *bool, deadband float64) bool {
+	if deadband > 0 && *has && math.Abs(v-*last) <= deadband {
+		return true
+	}
+	*last = v
+	*has = true
+	return false
+}
+
+// smoothAlpha is the weight of a new reading in the exponentially
+// weighted moving average of temperature and humidity, 0 disables
+var smoothAlpha float64
+
+// smooth adds v to the moving average avg and returns it.
+func smooth(v float64, avg *float64, has *bool) float64 {
+	if smoothAlpha <= 0 {
+		return v
+	}
+	if *has {
+		v = smoothAlpha*v + (1-smoothAlpha)*(*avg)
+	}
+	*avg = v
+	*has = true
+	return v
+}
+
+// medianWindow is the number of readings of temperature and humidity
+// whose median is exported, 0 or 1 disables
+var medianWindow int
+
+// median adds v to the last readings recent and returns their median.
+func median(v float64, recent *[]float64) float64 {
+	if medianWindow <= 1 {
+		return v
+	}
+	*recent = append(*recent, v)
+	if n := len(*recent); n > medianWindow {
+		*recent = (*recent)[n-medianWindow:]
+	}
+	sorted := append([]float64(nil), *recent...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 0 {
+		return (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+	return sorted[n/2]
+}
+
+// known reports whether mac is a sensor that has not expired yet.
+func known(mac string) bool {
+	expirersLock.Lock()
+	defer expirersLock.Unlock()
+	_, ok := expirers[mac]
+	return ok
+}
+
+func macWithColons(mac string) string {
+	return strings.ToUpper(fmt.Sprintf("%s:%s:%s:%s:%s:%s",
+		mac[0:2],
+		mac[2:4],
+		mac[4:6],
+		mac[6:8],
+		mac[8:10],
+		mac[10:12]))
+}
+
+func macWithoutColons(mac string) string {
+	return strings.ReplaceAll(strings.ToUpper(mac), ":", "")
+}
+
+// keyStore holds the decryption keys per MAC, safe for concurrent use.
+type keyStore struct {
+	lock sync.RWMutex
+	keys map[string][]byte
+}
+
+func (s *keyStore) Get(mac string) ([]byte, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	key, ok := s.keys[mac]
+	return key, ok
+}
+
+// Set replaces all keys.
+func (s *keyStore) Set(keys map[string][]byte) {
+	s.lock.Lock()
+	s.keys = keys
+	s.lock.Unlock()
+}
+
+var decryptionKeys = &keyStore{keys: make(map[string][]byte)}
+
+// calibration offsets, from the keyfile
+type calibration struct {
+	temp float64
+	hum  float64
+}
+
+var calibrations = make(map[string]calibration)
+
+// keysLock guards names and calibrations, which are replaced on
+// reload
+var keysLock sync.RWMutex
+
+func lookupCalibration(mac string) calibration {
+	keysLock.RLock()
+	defer keysLock.RUnlock()
+	return calibrations[mac]
+}
+
+// skipStockBattery drops the battery percentage of the stock firmware
+var skipStockBattery bool
+
+var errLength = errors.New("short frame")
+
+// MiBeacon frame control bits
+const (
+	miEncrypted  = 0x0008
+	miMacInclude = 0x0010
+	miCapInclude = 0x0020
+	miObjInclude = 0x0040
+	miCapIO      = 0x20 // in the capability byte
+)
+
+// models of the MiBeacon product ids, exported as sensor label; other
+// ids are exported as e.g. MiBeacon-0a1c
+var miProducts = map[uint16]string{
+	0x055b: Sensor,
+	0x01aa: "LYWSDCGQ",
+	0x045b: "LYWSD02",
+	0x0347: "CGG1",
+	0x0387: "MHO-C401",
+}
+
+// hasMiBeaconProduct reports whether a carries a MiBeacon frame of
+// one of the miProducts, whatever the vendor prefix of its MAC.
+func hasMiBeaconProduct(a ble.Advertisement) bool {
+	for _, sd := range a.ServiceData() {
+		if sd.UUID.Equal(XiaomiIncUUID) && len(sd.Data) >= 4 {
+			if _, ok := miProducts[binary.LittleEndian.Uint16(sd.Data[2:4])]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decodeMiBeaconData decodes a MiBeacon frame of the stock firmware,
+// decrypting it with the key of frameMac if the frame control says so.
+func decodeMiBeaconData(data []byte, frameMac string) (sensorData, error) {
+	// frame control, product id, frame counter, MAC
+	if len(data) < 5+6 {
+		return sensorData{}, fmt.Errorf("%w of length %d", errLength, len(data))
+	}
+	fc := binary.LittleEndian.Uint16(data[0:2])
+	if fc&miMacInclude == 0 {
+		return sensorData{}, fmt.Errorf("MiBeacon frame without MAC")
+	}
+
+	mac := fmt.Sprintf("%X", []byte{
+		data[10], data[9], data[8], data[7], data[6], data[5],
+	})
+
+	if mac != frameMac {
+		return sensorData{}, fmt.Errorf("%w: embedded %s", errMacMismatch, mac)
+	}
+
+	sd := sensorData{
+		mac:         mac,
+		embeddedMac: payloadMac(data, 5),
+		format:      "stock",
+		frame:       float64(data[4]),
+		fields:      fieldFrame,
+	}
+	product := binary.LittleEndian.Uint16(data[2:4])
+	if model, ok := miProducts[product]; !ok {
+		sd.model = fmt.Sprintf("MiBeacon-%04x", product)
+	} else if model != Sensor {
+		sd.model = model
+	}
+
+	offset := 11
+	if fc&miCapInclude != 0 {
+		if len(data) < offset+1 {
+			return sensorData{}, fmt.Errorf("%w of length %d", errLength, len(data))
+		}
+		if data[offset]&miCapIO != 0 {
+			offset += 2
+		}
+		offset++
+	}
+	if fc&miObjInclude == 0 {
+		// e.g. a pairing beacon
+		return sd, nil
+	}
+	if len(data) < offset {
+		return sensorData{}, fmt.Errorf("%w of length %d", errLength, len(data))
+	}
+
+	if fc&miEncrypted == 0 {
+		return sd, decodeMiBeacon(data[offset:], &sd)
+	}
+
+	// payload, 3 byte counter, 4 byte token
+	if len(data) < offset+3+4 {
+		return sensorData{}, fmt.Errorf("%w of length %d", errLength, len(data))
+	}
+
+	key, ok := decryptionKeys.Get(mac)
+	if !ok {
+		return sensorData{}, fmt.Errorf("%w for MAC %s, skipped", errNoKey, mac)
+	}
+
+	ciphertext := []byte{}
+	ciphertext = append(ciphertext, data[offset:len(data)-7]...) // payload
+	ciphertext = append(ciphertext, data[len(data)-4:]...)       // token
+
+	counter := data[len(data)-7 : len(data)-4]
+
+	nonce := []byte{}
+	nonce = append(nonce, data[5:11]...) // reverse MAC
+	nonce = append(nonce, data[2:5]...)  // sensor type
+	nonce = append(nonce, counter...)    // counter
+
+	aes, err := aes.NewCipher(key[:])
+	if err != nil {
+		return sensorData{}, fmt.Errorf("aes.NewCipher: %s", err)
+	}
+	ccm, err := aesccm.NewCCM(aes, 4, 12)
+	if err != nil {
+		return sensorData{}, fmt.Errorf("aesccm.NewCCM: %s", err)
+	}
+
+	var Aad = []byte{0x11}
+
+	dst, err := ccm.Open([]byte{}, nonce, ciphertext, Aad)
+	if err != nil {
+		return sensorData{}, fmt.Errorf("%w MiBeacon frame from %s: %s", errDecrypt, mac, err)
+	}
+
+	sd.nonce = float64(uint32(counter[0]) | uint32(counter[1])<<8 | uint32(counter[2])<<16)
+	sd.fields |= fieldNonce
+
+	return sd, decodeMiBeacon(dst, &sd)
+}
+
+// decodeMiBeacon decodes the objects of a MiBeacon frame, each
+// consisting of a 2 byte id, a length byte and the value, into sd.
+func decodeMiBeacon(data []byte, sd *sensorData) error {
+	if len(data) == 0 {
+		return fmt.Errorf("%w: no objects", errLength)
+	}
+
+	for len(data) > 0 {
+		if len(data) < 3 || len(data) < 3+int(data[2]) {
+			return fmt.Errorf("%w: truncated object", errLength)
+		}
+		id := binary.LittleEndian.Uint16(data[0:2])
+		v := data[3 : 3+int(data[2])]
+		data = data[3+len(v):]
+
+		switch {
+		case id == 0x1004 && len(v) >= 2: // temperature, 0.1°C
+			sd.temp = float64(int16(binary.LittleEndian.Uint16(v))) / 10.0
+			sd.fields |= fieldTemp
+		case id == 0x1006 && len(v) >= 2: // humidity, 0.1%
+			sd.hum = float64(binary.LittleEndian.Uint16(v)) / 10.0
+			sd.fields |= fieldHum
+		case id == 0x100a && len(v) >= 1: // battery, %
+			sd.batp = float64(v[0])
+			sd.fields |= fieldBatp
+		case id == 0x100d && len(v) >= 4: // temperature + humidity
+			sd.temp = float64(int16(binary.LittleEndian.Uint16(v[0:2]))) / 10.0
+			sd.hum = float64(binary.LittleEndian.Uint16(v[2:4])) / 10.0
+			sd.fields |= fieldTemp | fieldHum
+		}
+	}
+
+	return nil
+}
+
+func decodeSign(i uint16) int {
+	if i < 32768 {
+		return int(i)
+	} else {
+		return int(i) - 65536
+	}
+}
+
+// decoder decodes the frames of one format.
+type decoder struct {
+	format string
+	uuid   ble.UUID // of the service data, nil for manufacturer data
+	match  func(data []byte) bool
+	decode func(data []byte, frameMac string) (sensorData, error)
+	expiry *time.Duration
+
+	// whether the frame is a counter of each advertisement
+	countsFrames bool
+}
+
+func length(n int) func([]byte) bool {
+	return func(data []byte) bool { return len(data) == n }
+}
+
+// decoders are tried in order, the first matching one is used.
+var decoders = []decoder{
+	{"atc", EnvironmentalSensingUUID, length(13), decodeATCData, &expiryAdv, true},
+	{"pvvx", EnvironmentalSensingUUID, length(15), decodePVVXData, &expiryAdv, true},
+	{"stock", XiaomiIncUUID, nil, decodeMiBeaconData, &expiryStock, true},
+	{"bthome", BTHomeUUID, nil, decodeBTHomeV2Data, &expiryAdv, true},
+	{"qingping", QingpingUUID, nil, decodeQingpingData, &expiryAdv, false},
+	{"thermobeacon", nil, isThermobeacon, decodeThermobeaconData, &expiryAdv, false},
+}
+
+// findDecoder returns the decoder for data with uuid, and whether any
+// decoder handles uuid at all.
+func findDecoder(uuid ble.UUID, data []byte) (*decoder, bool) {
+	known := false
+	for i := range decoders {
+		d := &decoders[i]
+		if !d.uuid.Equal(uuid) {
+			continue
+		}
+		known = true
+		if d.match == nil || d.match(data) {
+			return d, true
+		}
+	}
+	return nil, known
+}
+
+// registerFrame decodes data from frameMac with d and records it.
+func registerFrame(d *decoder, data []byte, frameMac string, adapter string, rssi int) {
+	framesCounter.WithLabelValues(frameMac, d.format).Inc()
+	sd, err := d.decode(data, frameMac)
+	if errors.Is(err, errNoKey) {
+		decodeErrorsCounter.WithLabelValues(frameMac, "no_key").Inc()
+		warnOnce(err.Error())
+		return
+	}
+	if err != nil {
+		decodeError(frameMac, err)
+		return
+	}
+	if skipStockBattery && sd.format == "stock" {
+		// reported as 100% until the battery is nearly empty
+		sd.fields &^= fieldBatp
+	}
+
+	identify(sd)
+	bump(sd.mac, *d.expiry)
+	if !setRSSI(sd.mac, adapter, rssi) {
+		// heard better by another adapter
+		return
+	}
+	if d.countsFrames && trackFrame(sd) {
+		return
+	}
+	observeInterval(sd.mac)
+	recordData(sd)
+}
+
+// trackFrame counts the frames missed since the last frame of the MAC
+// of sd, from the frame counter of sd.bits bits.  It reports whether sd
+// has the same counter as the last frame, i.e. is another reception of
+// the same advertisement.
+func trackFrame(sd sensorData) bool {
+	if sd.fields&fieldFrame == 0 {
+		return false
+	}
+	bits := sd.bits
+	if bits == 0 {
+		bits = 8
+	}
+
+	statesLock.Lock()
+	st := sensor(sd.mac)
+	last, hasLast := st.frame, st.hasFrame && st.frameBits == bits
+	st.frame = sd.frame
+	st.frameBits = bits
+	st.hasFrame = true
+	statesLock.Unlock()
+
+	if !hasLast {
+		// first frame, or a counter of another format
+		return false
+	}
+	if last == sd.frame {
+		return true
+	}
+	mask := uint64(1)<<bits - 1
+	if delta := (uint64(sd.frame) - uint64(last)) & mask; delta > 1 {
+		framesMissedCounter.WithLabelValues(sd.mac).Add(float64(delta - 1))
+	}
+	return false
+}
+
+// identify records the format and model of sd before its metrics are
+// exported, so they carry the right sensor label.  A sensor that
+// changes its model is expired first, to drop the old label values.
+func identify(sd sensorData) {
+	if sd.format == "" {
+		return
+	}
+	model := sd.model
+	if model == "" {
+		model = Sensor
+	}
+	if known(sd.mac) && sensorModel(sd.mac) != model {
+		forget(sd.mac)
+	}
+	setFirmware(sd.mac, sd.format, model, sd.embeddedMac)
+}
+
+func recordData(sd sensorData) {
+	if sd.fields&fieldTemp != 0 {
+		logTemperature(sd.mac, sd.temp)
+	}
+	if sd.fields&fieldHum != 0 {
+		logHumidity(sd.mac, sd.hum)
+	}
+	if sd.fields&fieldBatp != 0 {
+		logBatteryPercent(sd.mac, sd.batp)
+	}
+	if sd.fields&fieldBatv != 0 {
+		logVoltage(sd.mac, sd.batv)
+	}
+	if sd.fields&fieldFrame != 0 {
+		frameGauge.WithLabelValues(labelValues(sd.mac)...).Set(sd.frame)
+	}
+	if sd.fields&fieldFlags != 0 {
+		reedGauge.WithLabelValues(labelValues(sd.mac)...).Set(float64(sd.flags & 0x01))
+		triggerGauge.WithLabelValues(labelValues(sd.mac)...).Set(float64(sd.flags >> 1 & 0x01))
+	}
+	if sd.fields&fieldNonce != 0 {
+		nonceGauge.WithLabelValues(labelValues(sd.mac)...).Set(sd.nonce)
+	}
+	if sd.fields&fieldBatLow != 0 {
+		statesLock.Lock()
+		sensor(sd.mac).hasBatLow = true
+		statesLock.Unlock()
+		setBatteryLow(sd.mac, sd.batLow)
+	}
+	if influxURL != "" {
+		influxPoint(sd.mac)
+	}
+}
+
+type sensorData struct {
+	mac    string
+	format string
+	model  string // Sensor if empty
+	fields int
+	temp   float64
+	hum    float64
+	batp   float64
+	batv   float64
+	frame  float64
+	bits   int // of the frame counter, 8 if 0
+	flags  byte
+	nonce  float64
+	batLow bool
+
+	embeddedMac string // as found in the payload, in its byte order
+}
+
+// which fields of sensorData are valid
+const (
+	fieldTemp = 1 << iota
+	fieldHum
+	fieldBatp
+	fieldBatv
+	fieldFrame
+	fieldFlags
+	fieldNonce
+	fieldBatLow
+)
+
+// tempDivisors overrides the temperature resolution of the advertisement
+// formats per MAC, as steps per degree (e.g. 20 for 0.05°C steps).
+var tempDivisors = make(map[string]float64)
+
+func tempDivisor(mac string, def float64) float64 {
+	if d, ok := tempDivisors[mac]; ok {
+		return d
+	}
+	return def
+}
+
+// labels added to every metric with -label
+var constLabels = prometheus.Labels{}
+
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+type labelFlag struct{}
+
+func (labelFlag) String() string {
+	return ""
+}
+
+func (labelFlag) Set(s string) error {
+	for _, label := range strings.Split(s, ",") {
+		fields := strings.SplitN(label, "=", 2)
+		if len(fields) != 2 {
+			return fmt.Errorf("expected NAME=VALUE")
+		}
+		name := strings.TrimSpace(fields[0])
+		if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		constLabels[name] = fields[1]
+	}
+	return nil
+}
+
+type tempScaleFlag struct{}
+
+func (tempScaleFlag) String() string {
+	return ""
+}
+
+func (tempScaleFlag) Set(s string) error {
+	fields := strings.SplitN(s, "=", 2)
+	if len(fields) != 2 {
+		return fmt.Errorf("expected MAC=STEP")
+	}
+	step, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || step <= 0 {
+		return fmt.Errorf("invalid step %q", fields[1])
+	}
+	divisor := math.Round(1 / step)
+	if divisor < 1 || math.Abs(1/step-divisor) > 1e-6 {
+		return fmt.Errorf("invalid step %q, need 1/N like 0.05", fields[1])
+	}
+	tempDivisors[macWithoutColons(fields[0])] = divisor
+	return nil
+}
+
+// byte order of a MAC embedded in a payload
+type macOrder int
+
+const (
+	macForward macOrder = iota // as in the ATC format
+	macReverse                 // as in the PVVX format
+)
+
+func (o macOrder) String() string {
+	if o == macReverse {
+		return "reverse"
+	}
+	return "forward"
+}
+
+// findMac checks whether the 6 bytes at offset in data are frameMac,
+// in either byte order, and returns which order matched.
+func findMac(data []byte, offset int, frameMac string) (macOrder, error) {
+	if len(data) < offset+6 {
+		return 0, fmt.Errorf("frame too short for MAC")
+	}
+
+	fwd := fmt.Sprintf("%X", data[offset:offset+6])
+	if fwd == frameMac {
+		return macForward, nil
+	}
+
+	var rev string
+	for i := offset + 5; i >= offset; i-- {
+		rev += fmt.Sprintf("%02X", data[i])
+	}
+	if rev == frameMac {
+		return macReverse, nil
+	}
+
+	return 0, fmt.Errorf("%w %s != %s", errMacMismatch, fwd, frameMac)
+}
+
+// payloadMac returns the 6 bytes at offset in data as hex, in the
+// order they are sent.
+func payloadMac(data []byte, offset int) string {
+	return fmt.Sprintf("%X", data[offset:offset+6])
+}
+
+// expectMac is findMac for formats with a fixed byte order.
+func expectMac(data []byte, offset int, frameMac string, want macOrder) error {
+	order, err := findMac(data, offset, frameMac)
+	if err != nil {
+		return err
+	}
+	if order != want {
+		return fmt.Errorf("%w: %s in %s byte order, expected %s", errMacMismatch, frameMac, order, want)
+	}
+	return nil
+}
+
+// decodeATCData decodes the ATC format, where older atc1441 builds
+// send the MAC in reverse byte order.
+func decodeATCData(data []byte, frameMac string) (sensorData, error) {
+	if _, err := findMac(data, 0, frameMac); err != nil {
+		return sensorData{}, err
+	}
+	mac := frameMac
+
+	return sensorData{
+		mac:         mac,
+		embeddedMac: payloadMac(data, 0),
+		format:      "atc",
+		fields:      fieldTemp | fieldHum | fieldBatp | fieldBatv | fieldFrame,
+		temp:        float64(decodeSign(binary.BigEndian.Uint16(data[6:8]))) / tempDivisor(mac, 10),
+		hum:         float64(data[8]),
+		batp:        float64(data[9]),
+		batv:        float64(binary.BigEndian.Uint16(data[10:12])) / 1000.0,
+		frame:       float64(data[12]),
+	}, nil
+}
+
+func decodePVVXData(data []byte, frameMac string) (sensorData, error) {
+	if err := expectMac(data, 0, frameMac, macReverse); err != nil {
+		return sensorData{}, err
+	}
+	mac := frameMac
+
+	sd := sensorData{
+		mac:         mac,
+		embeddedMac: payloadMac(data, 0),
+		format:      "pvvx",
+		fields:      fieldTemp | fieldHum | fieldBatp | fieldBatv | fieldFrame,
+		temp:        float64(decodeSign(binary.LittleEndian.Uint16(data[6:8]))) / tempDivisor(mac, 100),
+		hum:         float64(decodeSign(binary.LittleEndian.Uint16(data[8:10]))) / 100.0,
+		batv:        float64(binary.LittleEndian.Uint16(data[10:12])) / 1000.0,
+		batp:        float64(data[12]),
+		frame:       float64(data[13]),
+	}
+	if len(data) > 14 {
+		// bit 0: reed switch, bit 1: GPIO trigger output,
+		// bit 2-4: trigger control and events
+		sd.flags = data[14]
+		sd.fields |= fieldFlags
+	}
+	return sd, nil
+}
+
+// Thermobeacon (Brifit, ORIA, ...) sensors use these company IDs
+var thermobeaconIDs = map[uint16]bool{
+	0x10: true, 0x11: true, 0x14: true, 0x15: true, 0x18: true, 0x1b: true,
+}
+
+func isThermobeacon(data []byte) bool {
+	return len(data) == 20 && thermobeaconIDs[binary.LittleEndian.Uint16(data[0:2])]
+}
+
+// decodeThermobeaconData decodes Thermobeacon manufacturer data:
+// company ID, flags, reverse MAC, voltage in mV, temperature and
+// humidity in 1/16 units, uptime.
+func decodeThermobeaconData(data []byte, frameMac string) (sensorData, error) {
+	if err := expectMac(data, 4, frameMac, macReverse); err != nil {
+		return sensorData{}, err
+	}
+	mac := frameMac
+
+	return sensorData{
+		mac:         mac,
+		embeddedMac: payloadMac(data, 4),
+		format:      "thermobeacon",
+		model:       "Thermobeacon",
+		fields:      fieldTemp | fieldHum | fieldBatv,
+		batv:        float64(binary.LittleEndian.Uint16(data[10:12])) / 1000.0,
+		temp:        float64(decodeSign(binary.LittleEndian.Uint16(data[12:14]))) / tempDivisor(mac, 16),
+		hum:         float64(binary.LittleEndian.Uint16(data[14:16])) / 16.0,
+	}, nil
+	// uptime := binary.LittleEndian.Uint32(data[16:20])
+}
+
+// only accept advertisements from these MACs, if set
+var allowedMacs = make(map[string]bool)
+
+// debugHex logs the raw data of all advertisements
+var debugHex bool
+
+// minRSSI drops advertisements weaker than this, if negative
+var minRSSI int
+
+// advHandler handles an advertisement received on adapter.
+func advHandler(a ble.Advertisement, adapter string) {
+	defer prometheus.NewTimer(advDuration).ObserveDuration()
+	defer recoverAdv(a)
+
+	mac := strings.ReplaceAll(strings.ToUpper(a.Addr().String()), ":", "")
+	if len(allowedMacs) > 0 && !allowedMacs[mac] {
+		return
+	}
+	if minRSSI < 0 && a.RSSI() < minRSSI {
+		// an RSSI of 0 and above means unknown, and passes
+		return
+	}
+
+	for _, sd := range a.ServiceData() {
+		if debugHex {
+			logger.Info("service data", "mac", mac, "rssi", a.RSSI(), "uuid", sd.UUID.String(), "data", hex.EncodeToString(sd.Data))
+		}
+		d, known := findDecoder(sd.UUID, sd.Data)
+		if d != nil {
+			registerFrame(d, sd.Data, mac, adapter, a.RSSI())
+		} else if known {
+			decodeErrorsCounter.WithLabelValues(mac, "length").Inc()
+			logger.Error("unknown data length", "mac", mac, "rssi", a.RSSI(), "uuid", sd.UUID.String(), "length", len(sd.Data))
+		} else {
+			logger.Error("unknown service data", "mac", mac, "rssi", a.RSSI(), "uuid", sd.UUID.String())
+		}
+	}
+
+	if md := a.ManufacturerData(); md != nil {
+		if debugHex {
+			logger.Info("manufacturer data", "mac", mac, "rssi", a.RSSI(), "data", hex.EncodeToString(md))
+		}
+		if d, _ := findDecoder(nil, md); d != nil {
+			registerFrame(d, md, mac, adapter, a.RSSI())
+		}
+	}
+
+	if name := a.LocalName(); name != "" && known(mac) {
+		updateInfo(mac, func(i *sensorInfo) {
+			i.advName = name
+		})
+	}
+}
+
+// recoverAdv logs and counts a panic while handling a, so scanning
+// continues.
+func recoverAdv(a ble.Advertisement) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	panicsCounter.Inc()
+
+	var data []string
+	for _, sd := range a.ServiceData() {
+		data = append(data, fmt.Sprintf("%s:%x", sd.UUID, sd.Data))
+	}
+	if md := a.ManufacturerData(); md != nil {
+		data = append(data, fmt.Sprintf("manufacturer:%x", md))
+	}
+	logger.Error("panic while handling advertisement", "mac", a.Addr().String(),
+		"panic", fmt.Sprint(r), "data", strings.Join(data, " "))
+}
+
+// parseOptions splits the rest of a keyfile line into the name and
+// the key=value options.
+func parseOptions(s string) (string, calibration, error) {
+	var words []string
+	var cal calibration
+	for _, word := range strings.Fields(s) {
+		kv := strings.SplitN(word, "=", 2)
+		if len(kv) != 2 {
+			words = append(words, word)
+			continue
+		}
+		v, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil {
+			return "", cal, err
+		}
+		switch kv[0] {
+		case "temp_offset":
+			cal.temp = v
+		case "hum_offset":
+			cal.hum = v
+		default:
+			return "", cal, fmt.Errorf("unknown option %s", kv[0])
+		}
+	}
+	return strings.Join(words, " "), cal, nil
+}
+
+// keyLine is a parsed line of the keyfile.
+type keyLine struct {
+	mac  string
+	key  []byte // nil for -
+	name string
+	cal  calibration
+}
+
+// parseKeyLine parses a keyfile line of the form MAC KEY [OPTIONS...].
+func parseKeyLine(line string) (keyLine, error) {
+	var kl keyLine
+	// fields may be separated by any whitespace
+	fields := strings.Fields(line)
+	if len(fields) > 3 {
+		fields = []string{fields[0], fields[1], strings.Join(fields[2:], " ")}
+	}
+	if len(fields) < 2 {
+		return kl, fmt.Errorf("expected MAC KEY")
+	}
+	if _, err := hex.DecodeString(fields[0]); err != nil || len(fields[0]) != 12 {
+		return kl, fmt.Errorf("invalid MAC %q, need 12 hex digits", fields[0])
+	}
+	kl.mac = fields[0]
+	if fields[1] != "-" {
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return kl, fmt.Errorf("invalid hex in key: %s", err)
+		}
+		if len(key) != 16 {
+			return kl, fmt.Errorf("key has %d bytes, need 16", len(key))
+		}
+		kl.key = key
+	}
+	if len(fields) > 2 {
+		name, cal, err := parseOptions(fields[2])
+		if err != nil {
+			return kl, err
+		}
+		kl.name, kl.cal = name, cal
+	}
+	return kl, nil
+}
+
+// checkKeys prints the status of each line of the keyfile filename and
+// a summary, and returns an error if any line is invalid.
+func checkKeys(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	seen := make(map[string]int)
+	var valid, invalid, duplicate int
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kl, err := parseKeyLine(line)
+		if err != nil {
+			fmt.Printf("%s:%d: invalid: %s\n", filename, n, err)
+			invalid++
+			continue
+		}
+		valid++
+		if first, ok := seen[kl.mac]; ok {
+			fmt.Printf("%s:%d: duplicate %s, overrides line %d\n", filename, n, kl.mac, first)
+			duplicate++
+		} else if kl.key == nil {
+			fmt.Printf("%s:%d: ok %s, no key\n", filename, n, kl.mac)
+		} else {
+			fmt.Printf("%s:%d: ok %s\n", filename, n, kl.mac)
+		}
+		seen[kl.mac] = n
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	fmt.Printf("%d valid, %d invalid, %d duplicate\n", valid, invalid, duplicate)
+	if invalid > 0 {
+		return fmt.Errorf("%d invalid lines in %s", invalid, filename)
+	}
+	return nil
+}
+
+func loadKeys(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	newKeys := make(map[string][]byte)
+	newNames := make(map[string]string)
+	newCalibrations := make(map[string]calibration)
+
+	seen := make(map[string]int)
+
+	scanner := bufio.NewScanner(file)
+	scanner.Split(bufio.ScanLines)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kl, err := parseKeyLine(line)
+		if err != nil {
+			logger.Error("invalid config line, ignored", "line", line, "err", err)
+			continue
+		}
+		if first, ok := seen[kl.mac]; ok {
+			logger.Warn("duplicate MAC in config, last line wins", "mac", kl.mac, "line", n, "first", first)
+			delete(newKeys, kl.mac)
+			delete(newNames, kl.mac)
+			delete(newCalibrations, kl.mac)
+		}
+		seen[kl.mac] = n
+		if kl.key != nil {
+			newKeys[kl.mac] = kl.key
+		}
+		if kl.name != "" {
+			newNames[kl.mac] = kl.name
+		}
+		if kl.cal != (calibration{}) {
+			newCalibrations[kl.mac] = kl.cal
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// metrics of renamed sensors are deleted under their old name
+	keysLock.RLock()
+	var renamed []string
+	for mac, name := range names {
+		if newNames[mac] != name {
+			renamed = append(renamed, mac)
+		}
+	}
+	for mac := range newNames {
+		if _, ok := names[mac]; !ok {
+			renamed = append(renamed, mac)
+		}
+	}
+	keysLock.RUnlock()
+	for _, mac := range renamed {
+		forget(mac)
+	}
+
+	decryptionKeys.Set(newKeys)
+	keysLock.Lock()
+	names = newNames
+	calibrations = newCalibrations
+	keysLock.Unlock()
+
+	return nil
+}
+
+// logger is the shared logger, set up by -log-format in main
+var logger = slog.Default()
+
+func setupLogger(format string, level slog.Level) {
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = slog.Default().Handler()
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+	default:
+		fatal("unknown log format", "format", format)
+	}
+	logger = slog.New(levelHandler{level, h})
+}
+
+// levelHandler drops records below level, which the handler of
+// slog.Default can't do by itself.
+type levelHandler struct {
+	level slog.Level
+	h     slog.Handler
+}
+
+func (l levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= l.level
+}
+
+func (l levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	return l.h.Handle(ctx, r)
+}
+
+func (l levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return levelHandler{l.level, l.h.WithAttrs(attrs)}
+}
+
+func (l levelHandler) WithGroup(name string) slog.Handler {
+	return levelHandler{l.level, l.h.WithGroup(name)}
+}
+
+// fatal logs msg as error and exits.
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// logReading logs value of metric for mac, along with the format and
+// signal strength of the last frame.
+func logReading(mac, metric string, value float64) {
+	metric = prometheus.BuildFQName(metricsNamespace, "", metric)
+	args := []any{"mac", mac, "metric", metric, "value", value}
+	statesLock.Lock()
+	if st, ok := states[mac]; ok {
+		if st.info.firmware != "" {
+			args = append(args, "format", st.info.firmware)
+		}
+		if st.hasRSSI {
+			args = append(args, "rssi", st.rssi)
+		}
+	}
+	statesLock.Unlock()
+	logger.Debug("reading", args...)
+}
+
+var warned = make(map[string]bool)
+var warnedLock sync.Mutex
+
+// warnOnce logs msg only the first time it occurs.
+func warnOnce(msg string) {
+	warnedLock.Lock()
+	defer warnedLock.Unlock()
+	if !warned[msg] {
+		warned[msg] = true
+		logger.Warn(msg)
+	}
+}
+
+// readings outside these bounds are rejected
+var tempMin, tempMax = -40.0, 85.0
+var humMin, humMax = 0.0, 100.0
+
+// outlier reports and counts whether v is outside min..max.
+func outlier(mac, quantity string, v, min, max float64) bool {
+	if v >= min && v <= max {
+		return false
+	}
+	rejectedCounter.WithLabelValues(mac, quantity).Inc()
+	logger.Warn("rejected reading", "mac", mac, "quantity", quantity, "value", v)
+	return true
+}
+
+// weight of a new rate in the temperature trend, to dampen the steps
+// of the 0.1°C resolution
+const trendAlpha = 0.3
+
+// updateTrend updates the temperature trend of st with temp and returns
+// it, once two readings are known.  st must be locked.
+func updateTrend(st *sensorState, temp float64) (float64, bool) {
+	now := time.Now()
+	if st.trendTime.IsZero() {
+		st.trendTemp, st.trendTime = temp, now
+		return 0, false
+	}
+	elapsed := now.Sub(st.trendTime).Hours()
+	if elapsed < 1.0/3600 {
+		// same advertisement received again
+		return st.trend, st.hasTrend
+	}
+
+	rate := (temp - st.trendTemp) / elapsed
+	if st.hasTrend {
+		rate = trendAlpha*rate + (1-trendAlpha)*st.trend
+	}
+	st.trend, st.hasTrend = rate, true
+	st.trendTemp, st.trendTime = temp, now
+	return rate, true
+}
+
+func logTemperature(mac string, temp float64) {
+	temp += lookupCalibration(mac).temp
+	if outlier(mac, "temperature", temp, tempMin, tempMax) {
+		return
+	}
+
+	if smoothAlpha > 0 || medianWindow > 1 {
+		rawTempGauge.WithLabelValues(labelValues(mac)...).Set(temp)
+	}
+
+	statesLock.Lock()
+	st := sensor(mac)
+	temp = median(temp, &st.recentTemp)
+	temp = smooth(temp, &st.avgTemp, &st.hasAvgTemp)
+	trend, hasTrend := updateTrend(st, temp)
+	skip := inDeadband(temp, &st.temp, &st.hasTemp, tempDeadband)
+	statesLock.Unlock()
+	if hasTrend {
+		tempTrendGauge.WithLabelValues(labelValues(mac)...).Set(trend)
+	}
+	if skip {
+		return
+	}
+
+	tempGauge.WithLabelValues(labelValues(mac)...).Set(temp)
+	if exportHistogram {
+		tempHistogram.WithLabelValues(labelValues(mac)...).Observe(temp)
+	}
+	if exportFahrenheit {
+		fahrenheitGauge.WithLabelValues(labelValues(mac)...).Set(temp*9/5 + 32)
+	}
+	if exportMilli {
+		milliTempGauge.WithLabelValues(labelValues(mac)...).Set(math.Round(temp * 1000))
+	}
+	logReading(mac, "temperature_celsius", temp)
+	recordReading(mac, "temperature", temp)
+
+	logDerived(mac)
+}
+
+func logHumidity(mac string, hum float64) {
+	hum += lookupCalibration(mac).hum
+	if outlier(mac, "humidity", hum, humMin, humMax) {
+		return
+	}
+
+	if smoothAlpha > 0 || medianWindow > 1 {
+		rawHumGauge.WithLabelValues(labelValues(mac)...).Set(hum)
+	}
+
+	statesLock.Lock()
+	st := sensor(mac)
+	hum = median(hum, &st.recentHum)
+	hum = smooth(hum, &st.avgHum, &st.hasAvgHum)
+	skip := inDeadband(hum, &st.hum, &st.hasHum, humDeadband)
+	statesLock.Unlock()
+	if skip {
+		return
+	}
+
+	humGauge.WithLabelValues(labelValues(mac)...).Set(hum)
+	if exportMilli {
+		milliHumGauge.WithLabelValues(labelValues(mac)...).Set(math.Round(hum * 1000))
+	}
+	logReading(mac, "humidity_ratio", hum)
+	recordReading(mac, "humidity", hum)
+
+	logDerived(mac)
+}
+
+// logDerived updates the metrics computed from both the last
+// temperature and humidity of mac, which arrive separately for
+// some formats.
+func logDerived(mac string) {
+	statesLock.Lock()
+	st := sensor(mac)
+	ok := st.hasTemp && st.hasHum
+	temp, hum := st.temp, st.hum
+	statesLock.Unlock()
+	if !ok || hum <= 0 {
+		return
+	}
+
+	dp := dewPoint(temp, hum)
+	dewPointGauge.WithLabelValues(labelValues(mac)...).Set(dp)
+	risk := 0.0
+	if temp-dp <= condensationMargin {
+		risk = 1
+	}
+	condensationGauge.WithLabelValues(labelValues(mac)...).Set(risk)
+	absHumGauge.WithLabelValues(labelValues(mac)...).Set(absoluteHumidity(temp, hum))
+}
+
+// condensationMargin is the distance of the dew point to the
+// temperature in °C at which thermometer_condensation_risk is 1, as
+// colder surfaces nearby reach the dew point
+var condensationMargin = 3.0
+
+// absoluteHumidity computes the water content of air in g/m³ from the
+// saturation vapor pressure approximation by Bolton.
+func absoluteHumidity(temp, hum float64) float64 {
+	svp := 6.112 * math.Exp(17.67*temp/(temp+243.5)) // hPa
+	return svp * hum * 2.1674 / (273.15 + temp)
+}
+
+// dewPoint computes the dew point with the Magnus formula.
+func dewPoint(temp, hum float64) float64 {
+	const a, b = 17.62, 243.12
+	g := math.Log(hum/100) + a*temp/(b+temp)
+	return b * g / (a - g)
+}
+
+func logVoltage(mac string, batv float64) {
+	voltGauge.WithLabelValues(labelValues(mac)...).Set(batv)
+
+	statesLock.Lock()
+	explicit := sensor(mac).hasBatLow
+	statesLock.Unlock()
+	if !explicit {
+		setBatteryLow(mac, batv < batteryLow)
+	}
+	logReading(mac, "battery_volts", batv)
+	recordReading(mac, "voltage", batv)
+
+	if days, ok := batteryDaysRemaining(mac, batv); ok {
+		battDaysGauge.WithLabelValues(labelValues(mac)...).Set(days)
+	} else {
+		battDaysGauge.DeleteLabelValues(labelValues(mac)...)
+	}
+
+	if batteryFromVoltage {
+		setBatteryPercent(mac, voltagePercent(batv))
+	}
+}
+
+// batteryFromVoltage derives the battery percentage from the voltage,
+// for sensors reporting one
+var batteryFromVoltage bool
+
+type curvePoint struct {
+	v float64 // V
+	p float64 // %
+}
+
+// discharge curve of a CR2032 cell, by falling voltage
+var batteryCurve = []curvePoint{
+	{3.0, 100}, {2.9, 80}, {2.8, 60}, {2.7, 40}, {2.6, 25},
+	{2.5, 15}, {2.4, 8}, {2.3, 4}, {2.2, 2}, {2.1, 0},
+}
+
+// voltagePercent interpolates the battery percentage at v from
+// batteryCurve.
+func voltagePercent(v float64) float64 {
+	c := batteryCurve
+	if v >= c[0].v {
+		return c[0].p
+	}
+	for i := 1; i < len(c); i++ {
+		if v >= c[i].v {
+			return c[i].p + (v-c[i].v)*(c[i-1].p-c[i].p)/(c[i-1].v-c[i].v)
+		}
+	}
+	return c[len(c)-1].p
+}
+
+type batteryCurveFlag struct{}
+
+func (batteryCurveFlag) String() string {
+	return ""
+}
+
+func (batteryCurveFlag) Set(s string) error {
+	var c []curvePoint
+	for _, point := range strings.Split(s, ",") {
+		fields := strings.SplitN(point, "=", 2)
+		if len(fields) != 2 {
+			return fmt.Errorf("expected V=PERCENT")
+		}
+		v, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return fmt.Errorf("invalid voltage %q", fields[0])
+		}
+		p, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return fmt.Errorf("invalid percentage %q", fields[1])
+		}
+		c = append(c, curvePoint{v, p})
+	}
+	if len(c) < 2 {
+		return fmt.Errorf("need at least two points")
+	}
+	sort.Slice(c, func(i, j int) bool { return c[i].v > c[j].v })
+	batteryCurve = c
+	return nil
+}
+
+type voltSample struct {
+	t time.Time
+	v float64
+}
+
+// voltage at which the battery is considered empty
+var batteryEmpty = 2.2
+
+const voltSampleInterval = 10 * time.Minute
+const voltHistory = 30 * 24 * time.Hour
+
+// batteryDaysRemaining records batv in the voltage history of mac and
+// extrapolates its linear trend down to batteryEmpty.  It returns false
+// as long as there is no falling trend over at least a day.
+func batteryDaysRemaining(mac string, batv float64) (float64, bool) {
+	statesLock.Lock()
+	defer statesLock.Unlock()
+
+	st := sensor(mac)
+	now := time.Now()
+	h := st.volts
+	if n := len(h); n > 0 && batv > h[n-1].v+0.1 {
+		// battery was replaced, start over
+		h = nil
+	}
+	if n := len(h); n == 0 || now.Sub(h[n-1].t) >= voltSampleInterval {
+		h = append(h, voltSample{now, batv})
+	}
+	for len(h) > 0 && now.Sub(h[0].t) > voltHistory {
+		h = h[1:]
+	}
+	st.volts = h
+
+	if len(h) < 2 || h[len(h)-1].t.Sub(h[0].t) < 24*time.Hour {
+		return 0, false
+	}
+
+	// least squares fit, x in days since the first sample
+	var sx, sy, sxx, sxy float64
+	for _, s := range h {
+		x := s.t.Sub(h[0].t).Hours() / 24
+		sx += x
+		sy += s.v
+		sxx += x * x
+		sxy += x * s.v
+	}
+	n := float64(len(h))
+	slope := (n*sxy - sx*sy) / (n*sxx - sx*sx)
+	if slope >= 0 {
+		return 0, false
+	}
+
+	x := now.Sub(h[0].t).Hours() / 24
+	v := (sy-slope*sx)/n + slope*x
+	return math.Max(0, (v-batteryEmpty)/-slope), true
+}
+
+// batteryLow is the voltage below which thermometer_battery_low is 1
+// for sensors that don't report it
+var batteryLow = 2.5
+
+func setBatteryLow(mac string, low bool) {
+	v := 0.0
+	if low {
+		v = 1
+	}
+	battLowGauge.WithLabelValues(labelValues(mac)...).Set(v)
+}
+
+// logBatteryPercent logs the battery percentage reported by mac, which
+// is ignored if it's derived from the voltage instead.
+func logBatteryPercent(mac string, batp float64) {
+	if batteryFromVoltage {
+		statesLock.Lock()
+		hasVoltage := len(sensor(mac).volts) > 0
+		statesLock.Unlock()
+		if hasVoltage {
+			return
+		}
+	}
+	setBatteryPercent(mac, batp)
+}
+
+func setBatteryPercent(mac string, batp float64) {
+	battGauge.WithLabelValues(labelValues(mac)...).Set(batp)
+	logReading(mac, "battery_ratio", batp)
+	recordReading(mac, "battery", batp)
+}
+
+// recordReading keeps the last reading of mac for /sensors, and passes
+// it to the outputs other than Prometheus.
+func recordReading(mac, quantity string, value float64) {
+	statesLock.Lock()
+	sensor(mac).readings[quantity] = value
+	statesLock.Unlock()
+
+	if mqttClient != nil {
+		mqttPublish(mac, quantity, value)
+	}
+	if influxURL != "" {
+		influxRecord(mac, quantity, value)
+	}
+	if outputFile != "" {
+		outputRecord(mac, quantity, value)
+	}
+	if webhookURL != "" {
+		checkAlerts(mac, quantity, value)
+	}
+}
+
+// notificationHandler returns a callback recording the readings
+// decoded from the notifications of polled sensor mac.
+func notificationHandler(mac string, decode func([]byte, string) (sensorData, error)) func(req []byte) {
+	return func(req []byte) {
+		sd, err := decode(req, mac)
+		if err != nil {
+			decodeError(mac, err)
+			return
+		}
+		identify(sd)
+		bump(mac, pollExpiries[mac])
+		recordData(sd)
+	}
+}
+
+func decodeStockCharacteristic(mac string) func(req []byte) {
+	record := notificationHandler(mac, decodeStockNotification)
+	return func(req []byte) {
+		framesCounter.WithLabelValues(mac, "stock").Inc()
+		record(req)
+	}
+}
+
+func decodeAtcTemp(mac string) func(req []byte) {
+	return notificationHandler(mac, decodeAtcTempNotification)
+}
+
+func decodeAtcHumidity(mac string) func(req []byte) {
+	return notificationHandler(mac, decodeAtcHumidityNotification)
+}
+
+func decodeAtcBattery(mac string) func(req []byte) {
+	return notificationHandler(mac, decodeAtcBatteryNotification)
+}
+
+func shortNotification(req []byte, n int) error {
+	if len(req) < n {
+		return fmt.Errorf("%w: notification of length %d", errLength, len(req))
+	}
+	return nil
+}
+
+// decodeStockNotification decodes temperature, humidity and voltage
+// from the data characteristic of the stock firmware.
+func decodeStockNotification(req []byte, mac string) (sensorData, error) {
+	if err := shortNotification(req, 5); err != nil {
+		return sensorData{}, err
+	}
+	return sensorData{
+		mac:    mac,
+		format: "stock",
+		fields: fieldTemp | fieldHum | fieldBatv,
+		temp:   float64(decodeSign(binary.LittleEndian.Uint16(req[0:2]))) / 100.0,
+		hum:    float64(req[2]),
+		batv:   float64(int(binary.LittleEndian.Uint16(req[3:5]))) / 1000.0,
+	}, nil
+}
+
+// The custom firmware notifies each value on its own characteristic;
+// the format is left empty as it doesn't tell which firmware it is.
+
+func decodeAtcTempNotification(req []byte, mac string) (sensorData, error) {
+	if err := shortNotification(req, 2); err != nil {
+		return sensorData{}, err
+	}
+	return sensorData{
+		mac:    mac,
+		fields: fieldTemp,
+		temp:   float64(decodeSign(binary.LittleEndian.Uint16(req[0:2]))) / 10.0,
+	}, nil
+}
+
+func decodeAtcHumidityNotification(req []byte, mac string) (sensorData, error) {
+	if err := shortNotification(req, 2); err != nil {
+		return sensorData{}, err
+	}
+	return sensorData{
+		mac:    mac,
+		fields: fieldHum,
+		hum:    float64(binary.LittleEndian.Uint16(req[0:2])) / 100.0,
+	}, nil
+}
+
+func decodeAtcBatteryNotification(req []byte, mac string) (sensorData, error) {
+	if err := shortNotification(req, 1); err != nil {
+		return sensorData{}, err
+	}
+	return sensorData{
+		mac:    mac,
+		fields: fieldBatp,
+		batp:   float64(req[0]),
+	}, nil
+}
+
+// stockRecord is an hourly history record of the stock firmware.
+type stockRecord struct {
+	index   uint32
+	time    time.Time
+	maxTemp float64
+	maxHum  float64
+	minTemp float64
+	minHum  float64
+}
+
+// parseStockRecord decodes a history record of the stock firmware:
+// index, timestamp, max temperature, max humidity, min temperature,
+// min humidity.
+func parseStockRecord(req []byte) (stockRecord, error) {
+	if len(req) < 14 {
+		return stockRecord{}, fmt.Errorf("%w: history record of length %d", errLength, len(req))
+	}
+	return stockRecord{
+		index:   binary.LittleEndian.Uint32(req[0:4]),
+		time:    time.Unix(int64(binary.LittleEndian.Uint32(req[4:8])), 0),
+		maxTemp: float64(decodeSign(binary.LittleEndian.Uint16(req[8:10]))) / 10.0,
+		maxHum:  float64(req[10]),
+		minTemp: float64(decodeSign(binary.LittleEndian.Uint16(req[11:13]))) / 10.0,
+		minHum:  float64(req[13]),
+	}, nil
+}
+
+// decodeStockRecord exports the last history record of mac.
+func decodeStockRecord(mac string, req []byte) {
+	r, err := parseStockRecord(req)
+	if err != nil {
+		logger.Error("invalid history record, ignored", "mac", mac, "err", err)
+		return
+	}
+
+	onboardMinGauge.WithLabelValues(labelValues(mac)...).Set(r.minTemp)
+	onboardMaxGauge.WithLabelValues(labelValues(mac)...).Set(r.maxTemp)
+	logReading(mac, "onboard_min_celsius", r.minTemp)
+	logReading(mac, "onboard_max_celsius", r.maxTemp)
+}
+
+// readHistory reads the history of the stock firmware
+var readHistory bool
+
+// setClock sets the clock of the stock firmware, which timestamps the
+// history records
+var setClock bool
+
+// decodeHistory returns a callback logging the history records
+// notified by mac.
+func decodeHistory(mac string) func(req []byte) {
+	return func(req []byte) {
+		r, err := parseStockRecord(req)
+		if err != nil {
+			logger.Error("invalid history record, ignored", "mac", mac, "err", err)
+			return
+		}
+		logger.Info("history record", "mac", mac, "index", r.index,
+			"time", r.time.UTC().Format(time.RFC3339),
+			"min_temp", r.minTemp, "max_temp", r.maxTemp,
+			"min_hum", r.minHum, "max_hum", r.maxHum)
+	}
+}
+
+// with pollInterval, polled sensors are connected for pollDuration
+// once per interval instead of staying connected
+var pollInterval time.Duration
+var pollDuration = 30 * time.Second
+
+// pollTarget is a polled sensor with its own interval and expiry.
+type pollTarget struct {
+	mac      string
+	interval time.Duration // 0 stays connected
+	expiry   time.Duration
+}
+
+// expiry of the polled sensors, written before polling starts
+var pollExpiries = make(map[string]time.Duration)
+
+// the operation label values of thermometer_poll_errors_total
+var pollOperations = []string{"dial", "discover", "subscribe", "read"}
+
+// newPollTarget returns the pollTarget of mac, raising expiry to keep
+// the metrics between the cycles of interval.
+func newPollTarget(mac string, interval, expiry time.Duration) pollTarget {
+	if expiry <= 0 {
+		expiry = expiryConn
+	}
+	if interval > 0 && expiry < interval+pollDuration {
+		expiry = time.Duration(2.5 * float64(interval+pollDuration))
+	}
+	return pollTarget{macWithoutColons(mac), interval, expiry}
+}
+
+// loadPollFile reads the polled sensors from filename, one per line as
+// "MAC [INTERVAL [EXPIRY]]", with durations like 10m.
+func loadPollFile(filename string) ([]pollTarget, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var targets []pollTarget
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 3 || len(macWithoutColons(fields[0])) != 12 {
+			return nil, fmt.Errorf("%s:%d: expected MAC [INTERVAL [EXPIRY]]", filename, n)
+		}
+		var d [2]time.Duration
+		for i, f := range fields[1:] {
+			d[i], err = time.ParseDuration(f)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", filename, n, err)
+			}
+		}
+		targets = append(targets, newPollTarget(fields[0], d[0], d[1]))
+	}
+	return targets, scanner.Err()
+}
+
+// pollData polls t until ctx is done, reconnecting with exponential
+// backoff when connecting fails or the device disconnects.
+func pollData(ctx context.Context, t pollTarget) {
+	mac := t.mac
+	backoff := time.Second
+
+	for ctx.Err() == nil {
+		start := time.Now()
+		var err error
+		if t.interval > 0 {
+			cycleCtx, cancel := context.WithTimeout(ctx, pollDuration)
+			err = pollOnce(cycleCtx, mac)
+			cancel()
+		} else {
+			err = pollOnce(ctx, mac)
+		}
+		connectedGauge.WithLabelValues(labelValues(mac)...).Set(0)
+		if ctx.Err() != nil {
+			return
+		}
+
+		wait := backoff
+		if err == nil && t.interval > 0 {
+			backoff = time.Second
+			wait = t.interval - time.Since(start)
+		} else {
+			if time.Since(start) > time.Minute {
+				// the connection worked for a while
+				backoff = time.Second
+				wait = backoff
+			}
+			if err != nil {
+				logger.Error("polling failed", "mac", mac, "err", err, "retry", wait)
+			} else {
+				logger.Info("reconnecting", "mac", mac, "retry", wait)
+			}
+			backoff *= 2
+			if backoff > 5*time.Minute {
+				backoff = 5 * time.Minute
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// readDeviceInfo reads the device name and firmware revision, if
+// available.
+func readDeviceInfo(client ble.Client, profile *ble.Profile, mac string) deviceInfo {
+	read := func(uuid ble.UUID) string {
+		c := profile.FindCharacteristic(ble.NewCharacteristic(uuid))
+		if c == nil {
+			return ""
+		}
+		b, err := client.ReadCharacteristic(c)
+		if err != nil {
+			logger.Error("reading device info failed", "mac", mac, "uuid", uuid.String(), "err", err)
+			return ""
+		}
+		return strings.TrimRight(string(b), "\x00")
+	}
+
+	return deviceInfo{
+		deviceName: read(ble.UUID16(0x2a00)),
+		revision:   read(ble.UUID16(0x2a26)),
+	}
+}
+
+// pollSucceeded records a successful operation on polled sensor mac.
+func pollSucceeded(mac string) {
+	pollSuccessGauge.WithLabelValues(labelValues(mac)...).Set(float64(time.Now().Unix()))
 }
 
-var decryptionKeys = make(map[string][]byte)
+// pollOnce connects to mac and subscribes to its readings until ctx
+// is done or the device disconnects.
+func pollOnce(ctx context.Context, mac string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
 
-func decryptData(data []byte, frameMac string, rssi int) {
-	if len(data) < 11+3+4 {
-		return
-	}
+	dialCtx, cancel := context.WithTimeout(ctx, 50*time.Second)
+	defer cancel()
 
-	mac := fmt.Sprintf("%X", []byte{
-		data[10], data[9], data[8], data[7], data[6], data[5],
-	})
+	client, err := ble.Dial(dialCtx, ble.NewAddr(macWithColons(mac)))
+	if err != nil {
+		pollErrorsCounter.WithLabelValues(mac, "dial").Inc()
+		return fmt.Errorf("dial: %w", err)
+	}
+	profile, err := client.DiscoverProfile(true)
+	if err != nil {
+		pollErrorsCounter.WithLabelValues(mac, "discover").Inc()
+		client.CancelConnection()
+		return fmt.Errorf("discover profile: %w", err)
+	}
+	return pollProfile(ctx, client, profile, mac)
+}
 
-	if mac != frameMac {
-		return
+// pollProfile subscribes to the characteristics of profile that can be
+// decoded, and waits until ctx is done or client disconnects.
+func pollProfile(ctx context.Context, client ble.Client, profile *ble.Profile, mac string) error {
+	if _, ok := lookupDeviceInfo(mac); !ok {
+		setDeviceInfo(mac, readDeviceInfo(client, profile, mac))
 	}
 
-	var dst []byte
+	// whether any characteristic we can decode was found
+	supported := false
 
-	if data[12] == 0x10 {
-		// unencrypted
-		dst = data[11:]
-	} else {
-		key, ok := decryptionKeys[mac]
-		if !ok {
-			log.Printf("no key for MAC %s, skipped\n", mac)
-			return
+	// code for stock hardware
+
+	clientCharacteristicConfiguration := ble.MustParse("00002902-0000-1000-8000-00805f9b34fb")
+	if c := profile.FindCharacteristic(ble.NewCharacteristic(clientCharacteristicConfiguration)); c != nil {
+		b := []byte{0x01, 0x00}
+		err := client.WriteCharacteristic(c, b, false)
+		if err != nil {
+			logger.Error("enabling notifications failed", "mac", mac, "err", err)
 		}
+	}
 
-		ciphertext := []byte{}
-		ciphertext = append(ciphertext, data[11:len(data)-7]...) // payload
-		ciphertext = append(ciphertext, data[len(data)-4:]...)   // token
+	stockDataCharacteristic := ble.MustParse("ebe0ccc1-7a0a-4b0c-8a1a-6ff2997da3a6")
+	if c := profile.FindCharacteristic(ble.NewCharacteristic(stockDataCharacteristic)); c != nil {
+		supported = true
+		err := client.Subscribe(c, false, decodeStockCharacteristic(mac))
+		if err != nil {
+			pollErrorsCounter.WithLabelValues(mac, "subscribe").Inc()
+			logger.Error("subscribing failed", "mac", mac, "err", err)
+		} else {
+			pollSucceeded(mac)
+		}
+	}
 
-		nonce := []byte{}
-		nonce = append(nonce, data[5:11]...)                    // reverse MAC
-		nonce = append(nonce, data[2:5]...)                     // sensor type
-		nonce = append(nonce, data[len(data)-7:len(data)-4]...) // counter
+	stockTime := ble.MustParse("ebe0ccb7-7a0a-4b0c-8a1a-6ff2997da3a6")
+	if c := profile.FindCharacteristic(ble.NewCharacteristic(stockTime)); c != nil && setClock {
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, uint32(time.Now().Unix()))
+		if err := client.WriteCharacteristic(c, b, false); err != nil {
+			logger.Error("setting clock failed", "mac", mac, "err", err)
+		} else {
+			logger.Info("set clock", "mac", mac)
+		}
+	}
 
-		aes, err := aes.NewCipher(key[:])
+	stockLastRecord := ble.MustParse("ebe0ccbb-7a0a-4b0c-8a1a-6ff2997da3a6")
+	if c := profile.FindCharacteristic(ble.NewCharacteristic(stockLastRecord)); c != nil {
+		b, err := client.ReadCharacteristic(c)
 		if err != nil {
-			log.Print("aes.NewCipher: ", err)
-			return
+			pollErrorsCounter.WithLabelValues(mac, "read").Inc()
+			logger.Error("reading history record failed", "mac", mac, "err", err)
+		} else {
+			pollSucceeded(mac)
+			decodeStockRecord(mac, b)
 		}
-		ccm, err := aesccm.NewCCM(aes, 4, 12)
+	}
+
+	// subscribing makes the device send all its history records
+	stockHistory := ble.MustParse("ebe0ccbc-7a0a-4b0c-8a1a-6ff2997da3a6")
+	if c := profile.FindCharacteristic(ble.NewCharacteristic(stockHistory)); c != nil && readHistory {
+		err := client.Subscribe(c, false, decodeHistory(mac))
 		if err != nil {
-			log.Fatal("aesccm.NewCCM: ", err)
+			pollErrorsCounter.WithLabelValues(mac, "subscribe").Inc()
+			logger.Error("subscribing to history failed", "mac", mac, "err", err)
+		} else {
+			pollSucceeded(mac)
 		}
+	}
 
-		var Aad = []byte{0x11}
+	// code for custom hardware
 
-		dst, err = ccm.Open([]byte{}, nonce, ciphertext, Aad)
+	batteryServiceBatteryLevel := ble.UUID16(0x2a19)
+	if c := profile.FindCharacteristic(ble.NewCharacteristic(batteryServiceBatteryLevel)); c != nil {
+		supported = true
+		err := client.Subscribe(c, false, decodeAtcBattery(mac))
 		if err != nil {
-			log.Print("couldn't decrypt: ", err)
-			return
+			pollErrorsCounter.WithLabelValues(mac, "subscribe").Inc()
+			logger.Error("subscribing failed", "mac", mac, "err", err)
+		} else {
+			pollSucceeded(mac)
 		}
 	}
 
-	bump(mac, ExpiryStock)
-
-	if dst[0] == 0x04 { // temperature
-		temp := float64(binary.LittleEndian.Uint16(dst[3:5])) / 10.0
-		logTemperature(mac, temp)
+	environmentalSensingTemperatureCelsius := ble.UUID16(0x2a1f)
+	if c := profile.FindCharacteristic(ble.NewCharacteristic(environmentalSensingTemperatureCelsius)); c != nil {
+		supported = true
+		err := client.Subscribe(c, false, decodeAtcTemp(mac))
+		if err != nil {
+			pollErrorsCounter.WithLabelValues(mac, "subscribe").Inc()
+			logger.Error("subscribing failed", "mac", mac, "err", err)
+		} else {
+			pollSucceeded(mac)
+		}
+	}
 
+	environmentalSensingHumidity := ble.UUID16(0x2a6f)
+	if c := profile.FindCharacteristic(ble.NewCharacteristic(environmentalSensingHumidity)); c != nil {
+		supported = true
+		err := client.Subscribe(c, false, decodeAtcHumidity(mac))
+		if err != nil {
+			pollErrorsCounter.WithLabelValues(mac, "subscribe").Inc()
+			logger.Error("subscribing failed", "mac", mac, "err", err)
+		} else {
+			pollSucceeded(mac)
+		}
 	}
-	if dst[0] == 0x06 { // humidity
-		hum := float64(binary.LittleEndian.Uint16(dst[3:5])) / 10.0
-		logHumidity(mac, hum)
+
+	if !supported {
+		client.CancelConnection()
+		return fmt.Errorf("no supported characteristics, not a LYWSD03MMC?")
 	}
-	if dst[0] == 0x0A { // battery
-		// XXX always 100%?
-		batp := float64(dst[3])
-		logBatteryPercent(mac, batp)
+
+	connectedGauge.WithLabelValues(labelValues(mac)...).Set(1)
+
+	select {
+	case <-ctx.Done():
+		client.CancelConnection()
+	case <-client.Disconnected():
+		logger.Info("disconnected", "mac", mac)
 	}
-	if dst[0] == 0x0d && dst[2] == 0x04 { // temperature + humidity
-		temp := float64(binary.LittleEndian.Uint16(dst[3:5])) / 10.0
-		logTemperature(mac, temp)
-		hum := float64(binary.LittleEndian.Uint16(dst[5:7])) / 10.0
-		logHumidity(mac, hum)
+	return nil
+}
+
+// listen listens on the TCP addr, or on the Unix socket path for
+// addr "unix:path".
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
 	}
 
-	rssiGauge.WithLabelValues(Sensor, mac).Set(float64(rssi))
+	// remove a stale socket of a previous run
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
 }
 
-func decodeSign(i uint16) int {
-	if i < 32768 {
-		return int(i)
-	} else {
-		return int(i) - 65536
+// systemdListener returns the first socket passed by systemd socket
+// activation, or nil when not socket-activated.
+func systemdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
 	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	// passed file descriptors start at 3
+	f := os.NewFile(3, "LISTEN_FD_3")
+	defer f.Close()
+	syscall.CloseOnExec(3)
+	return net.FileListener(f)
 }
 
-func registerData(data []byte, frameMac string, rssi int) {
-	var sd sensorData
-	var err error
-	switch len(data) {
-	case 13:
-		sd, err = decodeATCData(data, frameMac)
-		if err != nil {
-			log.Print(err)
+// basicAuth requires user and pass for h, except for the health checks,
+// which probes call without credentials.
+func basicAuth(h http.Handler, user, pass string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			h.ServeHTTP(w, r)
 			return
 		}
-	case 15:
-		sd, err = decodePVVXData(data, frameMac)
-		if err != nil {
-			log.Print(err)
+		u, p, _ := r.BasicAuth()
+		userOk := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+		passOk := subtle.ConstantTimeCompare([]byte(p), []byte(pass)) == 1
+		if !userOk || !passOk {
+			w.Header().Set("WWW-Authenticate", `Basic realm="lywsd03mmc-exporter"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
-	default:
-		log.Printf("unknown data length %d\n", len(data))
-		return
-	}
-
-	bump(sd.mac, ExpiryAtc)
-
-	logTemperature(sd.mac, sd.temp)
-	logHumidity(sd.mac, sd.hum)
-	logBatteryPercent(sd.mac, sd.batp)
-	logVoltage(sd.mac, sd.batv)
-
-	frameGauge.WithLabelValues(Sensor, sd.mac).Set(sd.frame)
-	rssiGauge.WithLabelValues(Sensor, sd.mac).Set(float64(rssi))
+		h.ServeHTTP(w, r)
+	})
 }
 
-type sensorData struct {
-	mac   string
-	temp  float64
-	hum   float64
-	batp  float64
-	batv  float64
-	frame float64
+type sensorJSON struct {
+	MAC         string   `json:"mac"`
+	Name        string   `json:"name"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	Humidity    *float64 `json:"humidity,omitempty"`
+	Battery     *float64 `json:"battery,omitempty"`
+	Voltage     *float64 `json:"voltage,omitempty"`
+	RSSI        *int     `json:"rssi,omitempty"`
+	LastSeen    int64    `json:"last_seen"`
 }
 
-func decodeATCData(data []byte, frameMac string) (sensorData, error) {
-	mac := fmt.Sprintf("%X", data[0:6])
-	if mac != frameMac {
-		return sensorData{}, fmt.Errorf("MAC mismatch %s != %s", mac, frameMac)
+// serveSensors lists the last readings of all live sensors as JSON.
+func serveSensors(w http.ResponseWriter, r *http.Request) {
+	sensors := []sensorJSON{}
+
+	statesLock.Lock()
+	for mac, st := range states {
+		if !known(mac) {
+			continue
+		}
+		value := func(quantity string) *float64 {
+			if v, ok := st.readings[quantity]; ok {
+				return &v
+			}
+			return nil
+		}
+		s := sensorJSON{
+			MAC:         mac,
+			Name:        sensorName(mac),
+			Temperature: value("temperature"),
+			Humidity:    value("humidity"),
+			Battery:     value("battery"),
+			Voltage:     value("voltage"),
+			LastSeen:    st.lastSeen.Unix(),
+		}
+		if st.hasRSSI {
+			rssi := st.rssi
+			s.RSSI = &rssi
+		}
+		sensors = append(sensors, s)
 	}
+	statesLock.Unlock()
 
-	return sensorData{
-		mac:   mac,
-		temp:  float64(decodeSign(binary.BigEndian.Uint16(data[6:8]))) / 10.0,
-		hum:   float64(data[8]),
-		batp:  float64(data[9]),
-		batv:  float64(binary.BigEndian.Uint16(data[10:12])) / 1000.0,
-		frame: float64(data[12]),
-	}, nil
+	sort.Slice(sensors, func(i, j int) bool { return sensors[i].MAC < sensors[j].MAC })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sensors)
 }
 
-func decodePVVXData(data []byte, frameMac string) (sensorData, error) {
-	var mac string
-	for i := 5; i >= 0; i-- {
-		mac += fmt.Sprintf("%02X", data[i])
+func clientCAConfig(filename string) *tls.Config {
+	pem, err := os.ReadFile(filename)
+	if err != nil {
+		fatal("reading client CA failed", "err", err)
 	}
-	if mac != frameMac {
-		return sensorData{}, fmt.Errorf("MAC mismatch %s != %s", mac, frameMac)
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		fatal("no certificates found", "file", filename)
+	}
+	return &tls.Config{
+		ClientCAs:  pool,
+		ClientAuth: tls.RequireAndVerifyClientCert,
 	}
-	return sensorData{
-		mac:   mac,
-		temp:  float64(decodeSign(binary.LittleEndian.Uint16(data[6:8]))) / 100.0,
-		hum:   float64(decodeSign(binary.LittleEndian.Uint16(data[8:10]))) / 100.0,
-		batv:  float64(binary.LittleEndian.Uint16(data[10:12])) / 1000.0,
-		batp:  float64(data[12]),
-		frame: float64(data[13]),
-	}, nil
-	// flags := float64(data[14])
 }
 
-func advHandler(a ble.Advertisement) {
-	mac := strings.ReplaceAll(strings.ToUpper(a.Addr().String()), ":", "")
+// deviceIDs are the HCI devices to scan on, set by -i
+var deviceIDs deviceFlag
 
-	for _, sd := range a.ServiceData() {
-		if sd.UUID.Equal(EnvironmentalSensingUUID) {
-			registerData(sd.Data, mac, a.RSSI())
-		} else if sd.UUID.Equal(XiaomiIncUUID) {
-			decryptData(sd.Data, mac, a.RSSI())
-		} else {
-			log.Printf("unknown service data: %s\n", sd.UUID)
+// defaultID is the device used for polling
+var defaultID int
+
+type deviceFlag []int
+
+func (f *deviceFlag) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *deviceFlag) Set(s string) error {
+	for _, id := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(id))
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid device %q", id)
 		}
+		*f = append(*f, n)
 	}
+	return nil
 }
 
-func loadKeys(filename string) {
-	file, err := os.Open(filename)
-	if err != nil {
-		log.Fatal(err)
+// scanLoop scans until ctx is done, reopening the device with
+// exponential backoff after errors.  It returns the device in use.
+func scanLoop(ctx context.Context, device ble.Device, id int, retries int, filter ble.AdvFilter) ble.Device {
+	adapter := fmt.Sprintf("hci%d", id)
+	handler := func(a ble.Advertisement) {
+		if filter(a) {
+			advHandler(a, adapter)
+		}
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	scanner.Split(bufio.ScanLines)
+	backoff := time.Second
+	failures := 0
+	for {
+		logger.Info("scanning", "adapter", adapter)
+		start := time.Now()
+		atomic.AddInt32(&scanning, 1)
+		err := device.Scan(ctx, true, handler)
+		atomic.AddInt32(&scanning, -1)
+		if err == nil || errors.Is(err, context.Canceled) {
+			return device
+		}
+		checkBusy(err, id)
 
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if strings.HasPrefix(line, "#") {
-			continue
+		if time.Since(start) > time.Minute {
+			// scanning worked for a while
+			failures = 0
+			backoff = time.Second
 		}
-		fields := strings.SplitN(line, " ", 2)
-		if len(fields[0]) != 12 || len(fields[1]) != 32 {
-			log.Print("invalid config line, ignored: ", line)
-			continue
+
+		device.Stop()
+		for {
+			failures++
+			if retries > 0 && failures > retries {
+				fatal("scanning failed, giving up", "err", err)
+			}
+			logger.Error("scanning failed", "err", err, "retry", backoff)
+			select {
+			case <-ctx.Done():
+				return device
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > 30*time.Second {
+				backoff = 30 * time.Second
+			}
+
+			var d ble.Device
+			d, err = dev.NewDevice("default", ble.OptDeviceID(id))
+			if err == nil {
+				device = d
+				break
+			}
 		}
-		mac := fields[0]
-		key, err := hex.DecodeString(fields[1])
-		if err != nil {
-			log.Print("invalid config line, ignored: ", line)
-			continue
+		if id == defaultID {
+			ble.SetDefaultDevice(device)
 		}
-		decryptionKeys[mac] = key
+		scanRestarts.Inc()
 	}
 }
 
-func logTemperature(mac string, temp float64) {
-	tempGauge.WithLabelValues(Sensor, mac).Set(temp)
-	log.Printf("%s thermometer_temperature_celsius %.1f\n", mac, temp)
-}
+// vendorFilter accepts advertisements from MACs starting with one of
+// the comma-separated prefixes, Thermobeacons and Qingping sensors.  Empty prefixes
+// accept everything.
+func vendorFilter(prefixes string) ble.AdvFilter {
+	var ps []string
+	for _, p := range strings.Split(prefixes, ",") {
+		if p = macWithoutColons(strings.TrimSpace(p)); p != "" {
+			ps = append(ps, p)
+		}
+	}
+	if len(ps) == 0 {
+		return func(a ble.Advertisement) bool { return true }
+	}
 
-func logHumidity(mac string, hum float64) {
-	humGauge.WithLabelValues(Sensor, mac).Set(hum)
-	log.Printf("%s thermometer_humidity_ratio %.0f\n", mac, hum)
+	return func(a ble.Advertisement) bool {
+		mac := macWithoutColons(a.Addr().String())
+		for _, p := range ps {
+			if strings.HasPrefix(mac, p) {
+				return true
+			}
+		}
+		return isThermobeacon(a.ManufacturerData()) || hasQingpingData(a) ||
+			hasMiBeaconProduct(a)
+	}
 }
 
-func logVoltage(mac string, batv float64) {
-	voltGauge.WithLabelValues(Sensor, mac).Set(batv)
-	log.Printf("%s thermometer_battery_volts %.3f\n", mac, batv)
+func checkBusy(err error, id int) {
+	if errors.Is(err, syscall.EBUSY) {
+		fatal(fmt.Sprintf("hci%d is busy: is another lywsd03mmc-exporter or a BlueZ scan running on it?", id), "err", err)
+	}
 }
 
-func logBatteryPercent(mac string, batp float64) {
-	battGauge.WithLabelValues(Sensor, mac).Set(batp)
-	log.Printf("%s thermometer_battery_ratio %.0f\n", mac, batp)
-}
+// held open for the lifetime of the process
+var lockFiles []*os.File
 
-func decodeStockCharacteristic(mac string) func(req []byte) {
-	return func(req []byte) {
-		temp := float64(int(binary.LittleEndian.Uint16(req[0:2]))) / 100.0
-		hum := float64(req[2])
-		batv := float64(int(binary.LittleEndian.Uint16(req[3:5]))) / 1000.0
+func lockDevice(id int) {
+	filename := fmt.Sprintf("/run/lywsd03mmc-exporter.hci%d.lock", id)
+	lockFile, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		fatal("opening lock file failed", "err", err)
+	}
+	lockFiles = append(lockFiles, lockFile)
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		fatal(fmt.Sprintf("hci%d is locked by another lywsd03mmc-exporter", id), "file", filename)
+	}
+}
 
-		bump(mac, ExpiryConn)
+func main() {
+	config := flag.String("k", "", "load keys from `file`")
+	listenAddr := flag.String("l", ":9265", "listen on `addr` (or unix:path)")
+	flag.Var(&deviceIDs, "i", "use device hci`N` (repeatable, or comma-separated)")
+	flag.Var(labelFlag{}, "label", "add `NAME=VALUE,...` as labels to every metric")
+	flag.Var(tempScaleFlag{}, "temp-scale", "decode temperature of `MAC=STEP` in STEP °C")
+	flag.Float64Var(&tempDeadband, "deadband-temp", 0, "only update temperature when it changes by more than `N` °C")
+	flag.Float64Var(&humDeadband, "deadband-hum", 0, "only update humidity when it changes by more than `N` percent")
+	flag.BoolVar(&skipStockBattery, "no-stock-battery", false, "don't export the battery percentage of the stock firmware")
+	flag.Float64Var(&tempMin, "temp-min", tempMin, "reject temperatures below `N` °C")
+	flag.Float64Var(&tempMax, "temp-max", tempMax, "reject temperatures above `N` °C")
+	flag.Float64Var(&humMin, "hum-min", humMin, "reject humidities below `N` percent")
+	flag.Float64Var(&humMax, "hum-max", humMax, "reject humidities above `N` percent")
+	flag.Float64Var(&condensationMargin, "condensation-margin", condensationMargin, "report condensation risk when the dew point is within `N` °C of the temperature")
+	flag.IntVar(&medianWindow, "median-window", 0, "export the median of the last `n` temperature and humidity readings")
+	flag.Float64Var(&smoothAlpha, "smooth-alpha", 0, "smooth temperature and humidity with weight `alpha` of new readings (0 disables)")
+	flag.BoolVar(&exportFahrenheit, "f", false, "also export temperature in Fahrenheit")
+	flag.BoolVar(&exportHistogram, "temp-histogram", false, "also export a histogram of the temperature readings")
+	flag.BoolVar(&exportMilli, "milli", false, "also export temperature and humidity in integer thousandths")
+	flag.DurationVar(&expiryAdv, "expiry-adv", ExpiryAtc, "expire custom firmware sensors after `duration`")
+	flag.DurationVar(&expiryStock, "expiry-stock", ExpiryStock, "expire stock firmware sensors after `duration`")
+	flag.DurationVar(&expiryConn, "expiry-conn", ExpiryConn, "expire polled sensors after `duration`")
+	flag.DurationVar(&expiryGrace, "expiry-grace", 0, "keep metrics of expired sensors with thermometer_up 0 for `duration`")
+	flag.Float64Var(&expiryMultiplier, "expiry-multiplier", 0, "expire sensors after `N` observed advertising intervals")
+	flag.DurationVar(&expiryMin, "expiry-min", expiryMin, "lower bound for -expiry-multiplier")
+	flag.DurationVar(&expiryMax, "expiry-max", expiryMax, "upper bound for -expiry-multiplier")
+	flag.BoolVar(&exportEmbeddedMac, "embedded-mac", false, "add the MAC decoded from the payload to thermometer_sensor_info")
+	flag.Float64Var(&batteryLow, "battery-low", batteryLow, "report the battery as low below `V` volts")
+	flag.Float64Var(&batteryEmpty, "battery-empty", batteryEmpty, "consider the battery empty at `V` volts")
+	flag.BoolVar(&batteryFromVoltage, "battery-from-voltage", false, "derive the battery percentage from the voltage")
+	flag.Var(batteryCurveFlag{}, "battery-curve", "use discharge curve `V=PERCENT,...` for -battery-from-voltage")
+	flag.IntVar(&minRSSI, "min-rssi", 0, "ignore advertisements weaker than `dBm` (e.g. -85)")
+	vendorPrefix := flag.String("vendor-prefix", TelinkVendorPrefix, "only scan MACs starting with comma-separated `prefixes` (empty accepts all)")
+	flag.BoolVar(&debugHex, "debug-hex", false, "log the raw data of every advertisement as hex")
+	flag.BoolVar(&readHistory, "history", false, "log the history records of polled stock firmware sensors")
+	flag.BoolVar(&setClock, "set-clock", false, "set the clock of polled stock firmware sensors")
+	checkConfig := flag.Bool("check-config", false, "check the keyfile given with -k and exit")
+	decrypt := flag.Bool("decrypt", false, "decode the frame given as `MAC [UUID:]HEX [KEY]` arguments and exit")
+	discoverTime := flag.Duration("discover", 0, "list the devices seen within `duration` (e.g. 10s) and exit")
+	only := flag.String("only", "", "only accept sensors in comma-separated `MACS`")
+	tlsCert := flag.String("tls-cert", "", "serve TLS with certificate `file`")
+	tlsKey := flag.String("tls-key", "", "serve TLS with private key `file`")
+	tlsClientCA := flag.String("tls-client-ca", "", "require TLS client certificates signed by CA `file`")
+	authUser := flag.String("auth-user", "", "require basic auth with `user`")
+	authPass := flag.String("auth-pass", "", "require basic auth with `password`")
+	flag.DurationVar(&pollInterval, "poll-interval", 0, "connect to polled sensors once every `duration` instead of staying connected")
+	pollFile := flag.String("poll-file", "", "poll the sensors listed in `file`")
+	flag.DurationVar(&pollDuration, "poll-duration", pollDuration, "collect readings for `duration` per -poll-interval cycle")
+	mqttBroker := flag.String("mqtt-broker", "", "publish readings to MQTT broker `url` (e.g. tcp://localhost:1883)")
+	flag.StringVar(&mqttPrefix, "mqtt-topic-prefix", mqttPrefix, "publish MQTT topics below `prefix`")
+	flag.StringVar(&mqttClientID, "mqtt-client-id", "", "connect to the MQTT broker as `id` (default lywsd03mmc-exporter-HOSTNAME)")
+	mqttUser := flag.String("mqtt-user", "", "authenticate to the MQTT broker as `user`")
+	mqttPass := flag.String("mqtt-pass", "", "authenticate to the MQTT broker with `password`")
+	flag.BoolVar(&mqttDiscovery, "mqtt-discovery", false, "publish Home Assistant MQTT discovery configs")
+	flag.BoolVar(&mqttDiscoveryRemove, "mqtt-discovery-remove", false, "remove discovery configs of expired sensors")
+	flag.StringVar(&mqttDiscoveryPrefix, "mqtt-discovery-prefix", mqttDiscoveryPrefix, "publish discovery configs below `prefix`")
+	flag.StringVar(&influxURL, "influx-url", "", "write readings to InfluxDB at `url` (e.g. http://localhost:8086 or udp://localhost:8089)")
+	flag.StringVar(&influxToken, "influx-token", "", "use the InfluxDB v2 API with `token`")
+	flag.StringVar(&influxOrg, "influx-org", "", "write to InfluxDB v2 organization `org`")
+	flag.StringVar(&influxDB, "influx-db", influxDB, "write to InfluxDB database (v1) or bucket (v2) `name`")
+	flag.DurationVar(&influxInterval, "influx-interval", influxInterval, "write to InfluxDB every `duration`")
+	flag.StringVar(&pushURL, "pushgateway-url", "", "push metrics to the Pushgateway at `url`")
+	flag.DurationVar(&pushInterval, "push-interval", pushInterval, "push to the Pushgateway every `duration`")
+	flag.StringVar(&pushJob, "push-job", pushJob, "push with job label `name`")
+	flag.StringVar(&pushInstance, "push-instance", "", "push with instance label `name` (default hostname)")
+	pushOnly := flag.Bool("push-only", false, "don't serve HTTP, only push")
+	federate := flag.String("federate", "", "re-export the metrics of the comma-separated peer exporter `urls`")
+	flag.DurationVar(&federateInterval, "federate-interval", federateInterval, "fetch the peers every `duration`")
+	flag.DurationVar(&federateStale, "federate-stale", federateStale, "drop the metrics of peers not fetched within `duration`")
+	replayFile := flag.String("replay", "", "handle the advertisements recorded in `file` instead of scanning")
+	flag.BoolVar(&noScan, "no-scan", false, "don't use Bluetooth, e.g. with -federate")
+	flag.StringVar(&outputFile, "output-file", "", "append every reading to `file`")
+	flag.StringVar(&outputFormat, "output-format", outputFormat, "write -output-file in `format` csv or ndjson")
+	flag.Int64Var(&outputMaxSize, "output-max-size", outputMaxSize, "rotate -output-file to file.1 at `bytes` (0 = never)")
+	flag.StringVar(&webhookURL, "webhook-url", "", "POST alerts to `url`")
+	flag.Var(alertRuleFlag{}, "alert-rule", "alert when `[MAC/]QUANTITY<VALUE or >VALUE` (repeatable)")
+	alertRulesFile := flag.String("alert-rules", "", "read alert rules from `file`")
+	flag.Float64Var(&alertHysteresis, "alert-hysteresis", alertHysteresis, "clear alerts when `amount` back from the threshold")
+	flag.DurationVar(&alertCooldown, "alert-cooldown", alertCooldown, "don't repeat an alert within `duration`")
+	logFormat := flag.String("log-format", "text", "log in `format` text or json")
+	logLevel := flag.String("log-level", "info", "log records of `level` error, warn, info or debug and above")
+	verbose := flag.Bool("v", false, "log every reading (-log-level debug)")
+	quiet := flag.Bool("q", false, "only log errors (-log-level error)")
+	scanRetries := flag.Int("scan-retries", 10, "give up after `N` consecutive scan failures (0 = never)")
+	flag.DurationVar(&readyWindow, "ready-window", 0, "only report ready on /readyz if a sensor was seen within `duration`")
+	noRuntimeMetrics := flag.Bool("no-runtime-metrics", false, "don't export the go_, process_ and promhttp_ metrics")
+	readyGate := flag.Bool("ready-gate", false, "serve only exporter_ready 0 until the first sensor is seen")
+	timestamps := flag.Bool("timestamps", false, "export samples with the time the sensor was last seen, and offer OpenMetrics")
+	namespace := flag.String("namespace", "thermometer", "prefix metric names with `namespace`")
+	stateFile := flag.String("state-file", "", "save the last readings to `file` on shutdown and restore them on start")
+	lock := flag.Bool("lock", false, "refuse to start if another instance uses the same device")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr,
+			"Usage: %s [FLAGS...] [MACS TO POLL...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
 
-		logTemperature(mac, temp)
-		logHumidity(mac, hum)
-		logVoltage(mac, batv)
+	if !*noRuntimeMetrics {
+		registry.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
 	}
-}
+	reg := prometheus.WrapRegistererWith(constLabels, registry)
+	func() {
+		defer func() {
+			// a -label clashing with the labels of a metric
+			if r := recover(); r != nil {
+				fatal("registering metrics failed", "err", fmt.Sprint(r))
+			}
+		}()
+		if *timestamps {
+			initMetrics(timestampRegisterer{reg}, *namespace)
+		} else {
+			initMetrics(reg, *namespace)
+		}
+	}()
 
-func decodeAtcTemp(mac string) func(req []byte) {
-	return func(req []byte) {
-		temp := float64(decodeSign(binary.LittleEndian.Uint16(req[0:2]))) / 10.0
-		bump(mac, ExpiryConn)
-		logTemperature(mac, temp)
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fatal("invalid log level", "level", *logLevel)
 	}
-}
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	if *quiet {
+		level = slog.LevelError
+	}
+	setupLogger(*logFormat, level)
 
-func decodeAtcHumidity(mac string) func(req []byte) {
-	return func(req []byte) {
-		hum := float64(binary.LittleEndian.Uint16(req[0:2])) / 100.0
-		bump(mac, ExpiryConn)
-		logHumidity(mac, hum)
+	if *pushOnly && pushURL == "" {
+		fatal("-push-only requires -pushgateway-url")
 	}
-}
 
-func decodeAtcBattery(mac string) func(req []byte) {
-	return func(req []byte) {
-		batp := float64(req[0])
-		bump(mac, ExpiryConn)
-		logBatteryPercent(mac, batp)
+	if expiryAdv <= 0 {
+		expiryAdv = ExpiryAtc
+	}
+	if expiryStock <= 0 {
+		expiryStock = ExpiryStock
+	}
+	if expiryConn <= 0 {
+		expiryConn = ExpiryConn
 	}
-}
 
-func pollData(mac string) {
-	mac = macWithoutColons(mac)
+	if *checkConfig {
+		if *config == "" {
+			fatal("-check-config requires -k")
+		}
+		if err := checkKeys(*config); err != nil {
+			fatal("checking keys failed", "err", err)
+		}
+		return
+	}
 
-	ctx := ble.WithSigHandler(context.WithTimeout(context.Background(), 50*time.Second))
+	if *decrypt {
+		args := flag.Args()
+		if len(args) < 2 || len(args) > 3 {
+			fatal("usage: -decrypt MAC [UUID:]HEX [KEY]")
+		}
+		key := ""
+		if len(args) == 3 {
+			key = args[2]
+		} else if *config != "" {
+			if err := loadKeys(*config); err != nil {
+				fatal("loading keys failed", "err", err)
+			}
+		}
+		if err := decryptFrame(args[0], args[1], key); err != nil {
+			fatal("decoding failed", "err", err)
+		}
+		return
+	}
 
-	client, err := ble.Dial(ctx, ble.NewAddr(macWithColons(mac)))
-	if err != nil {
-		log.Fatal("oops: ", err)
+	var targets []pollTarget
+	for _, mac := range flag.Args() {
+		targets = append(targets, newPollTarget(mac, pollInterval, expiryConn))
 	}
-	profile, err := client.DiscoverProfile(true)
-	if err != nil {
-		log.Fatal("oops: ", err)
+	if *pollFile != "" {
+		t, err := loadPollFile(*pollFile)
+		if err != nil {
+			fatal("loading poll file failed", "err", err)
+		}
+		targets = append(targets, t...)
+	}
+	for _, t := range targets {
+		pollExpiries[t.mac] = t.expiry
 	}
 
-	// code for stock hardware
+	if *config != "" {
+		if err := loadKeys(*config); err != nil {
+			fatal("loading keys failed", "err", err)
+		}
 
-	clientCharacteristicConfiguration := ble.MustParse("00002902-0000-1000-8000-00805f9b34fb")
-	if c := profile.FindCharacteristic(ble.NewCharacteristic(clientCharacteristicConfiguration)); c != nil {
-		b := []byte{0x01, 0x00}
-		err := client.WriteCharacteristic(c, b, false)
-		fmt.Printf("%v\n", err)
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				logger.Info("reloading", "file", *config)
+				if err := loadKeys(*config); err != nil {
+					logger.Error("reloading keys failed", "err", err)
+				}
+			}
+		}()
 	}
 
-	stockDataCharacteristic := ble.MustParse("ebe0ccc1-7a0a-4b0c-8a1a-6ff2997da3a6")
-	if c := profile.FindCharacteristic(ble.NewCharacteristic(stockDataCharacteristic)); c != nil {
-		err := client.Subscribe(c, false, decodeStockCharacteristic(mac))
-		if err != nil {
-			log.Print(err)
+	if *alertRulesFile != "" {
+		if err := loadAlertRules(*alertRulesFile); err != nil {
+			fatal("loading alert rules failed", "err", err)
 		}
 	}
+	if len(alertRules) > 0 && webhookURL == "" {
+		fatal("alert rules require -webhook-url")
+	}
 
-	// code for custom hardware
+	if *federate != "" {
+		if err := addPeers(*federate); err != nil {
+			fatal("invalid -federate", "err", err)
+		}
+	}
 
-	batteryServiceBatteryLevel := ble.UUID16(0x2a19)
-	if c := profile.FindCharacteristic(ble.NewCharacteristic(batteryServiceBatteryLevel)); c != nil {
-		err := client.Subscribe(c, false, decodeAtcBattery(mac))
+	var replayed []*replayAdv
+	if *replayFile != "" {
+		var err error
+		replayed, err = loadReplay(*replayFile)
 		if err != nil {
-			log.Print(err)
+			fatal("loading replay file failed", "err", err)
 		}
+		noScan = true
+		noExpiry = true
 	}
 
-	environmentalSensingTemperatureCelsius := ble.UUID16(0x2a1f)
-	if c := profile.FindCharacteristic(ble.NewCharacteristic(environmentalSensingTemperatureCelsius)); c != nil {
-		err := client.Subscribe(c, false, decodeAtcTemp(mac))
+	if noScan {
+		deviceIDs = nil
+	} else if len(deviceIDs) == 0 {
+		deviceIDs = deviceFlag{0}
+	}
+	if len(deviceIDs) > 0 {
+		defaultID = deviceIDs[0]
+	}
+
+	if *only != "" {
+		for _, mac := range strings.Split(*only, ",") {
+			allowedMacs[macWithoutColons(strings.TrimSpace(mac))] = true
+		}
+	}
+
+	devices := make([]ble.Device, len(deviceIDs))
+	for i, id := range deviceIDs {
+		if *lock {
+			lockDevice(id)
+		}
+
+		device, err := dev.NewDevice("default", ble.OptDeviceID(id))
 		if err != nil {
-			log.Print(err)
+			checkBusy(err, id)
+			fatal("opening device failed", "adapter", fmt.Sprintf("hci%d", id), "err", err)
 		}
+		devices[i] = device
 	}
 
-	environmentalSensingHumidity := ble.UUID16(0x2a6f)
-	if c := profile.FindCharacteristic(ble.NewCharacteristic(environmentalSensingHumidity)); c != nil {
-		err := client.Subscribe(c, false, decodeAtcHumidity(mac))
+	// used for polling and -discover
+	if len(devices) > 0 {
+		ble.SetDefaultDevice(devices[0])
+	}
+
+	if *discoverTime > 0 {
+		err := discover(*discoverTime, vendorFilter(*vendorPrefix))
+		for _, device := range devices {
+			device.Stop()
+		}
 		if err != nil {
-			log.Print(err)
+			fatal("scanning failed", "err", err)
 		}
+		return
 	}
-}
 
-func main() {
-	config := flag.String("k", "", "load keys from `file`")
-	listenAddr := flag.String("l", ":9265", "listen on `addr`")
-	deviceID := flag.Int("i", 0, "use device hci`N`")
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr,
-			"Usage: %s [FLAGS...] [MACS TO POLL...]\n", os.Args[0])
-		flag.PrintDefaults()
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		logger.Info("shutting down", "signal", sig.String())
+		cancel()
+	}()
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head><title>lywsd03mmc-exporter</title></head><body><h1>lywsd03mmc-exporter</h1><p><a href="/metrics">Metrics</a></p><p><a href="/sensors">Sensors</a></p></body></html>`))
+	})
+	registerBuildInfo(reg, *namespace)
+	var gatherer prometheus.Gatherer = registry
+	if len(peers) > 0 {
+		gatherer = prometheus.Gatherers{gatherer, federation{}}
+	}
+	metricsHandler := promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{EnableOpenMetrics: *timestamps})
+	if !*noRuntimeMetrics {
+		metricsHandler = promhttp.InstrumentMetricHandler(registry, metricsHandler)
+	}
+	if *readyGate {
+		reg.MustRegister(readyGauge)
+		notReady := prometheus.NewRegistry()
+		prometheus.WrapRegistererWith(constLabels, notReady).MustRegister(readyGauge)
+		metricsHandler = gateReady(metricsHandler,
+			promhttp.HandlerFor(notReady, promhttp.HandlerOpts{}))
+	}
+	http.HandleFunc("/sensors", serveSensors)
+	http.HandleFunc("/healthz", serveHealthz)
+	http.HandleFunc("/readyz", serveReadyz)
+	http.Handle("/metrics", promhttp.InstrumentHandlerDuration(scrapeDuration, metricsHandler))
+
+	srv := &http.Server{Addr: *listenAddr}
+	if *authUser != "" || *authPass != "" {
+		srv.Handler = basicAuth(http.DefaultServeMux, *authUser, *authPass)
 	}
-	flag.Parse()
 
-	if *config != "" {
-		loadKeys(*config)
+	if !*pushOnly {
+		ln, err := systemdListener()
+		if err != nil {
+			fatal("using the systemd socket failed", "err", err)
+		}
+		if ln != nil {
+			*listenAddr = ln.Addr().String()
+		} else {
+			ln, err = listen(*listenAddr)
+			if err != nil {
+				fatal("listening failed", "addr", *listenAddr, "err", err)
+			}
+		}
+		go func() {
+			logger.Info("Prometheus metrics listening", "addr", *listenAddr)
+			var err error
+			if *tlsCert != "" && *tlsKey != "" {
+				if *tlsClientCA != "" {
+					srv.TLSConfig = clientCAConfig(*tlsClientCA)
+				}
+				err = srv.ServeTLS(ln, *tlsCert, *tlsKey)
+			} else {
+				err = srv.Serve(ln)
+			}
+			if err != http.ErrServerClosed {
+				fatal("serving HTTP failed", "err", err)
+			}
+		}()
 	}
 
-	device, err := dev.NewDevice("default", ble.OptDeviceID(*deviceID))
-	if err != nil {
-		log.Fatal("oops: ", err)
+	if *mqttBroker != "" {
+		startMQTT(*mqttBroker, *mqttUser, *mqttPass)
 	}
 
-	ble.SetDefaultDevice(device)
+	if *stateFile != "" {
+		loadState(*stateFile)
+	}
 
-	go func() {
-		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Content-Type", "text/html")
-			w.Write([]byte(`<html><head><title>lywsd03mmc-exporter</title></head><body><h1>lywsd03mmc-exporter</h1><p><a href="/metrics">Metrics</a></p></body></html>`))
-		})
-		http.Handle("/metrics", promhttp.Handler())
-		log.Println("Prometheus metrics listening on", *listenAddr)
-		err := http.ListenAndServe(*listenAddr, nil)
-		if err != http.ErrServerClosed {
-			log.Fatal(err)
-			os.Exit(1)
+	var wg sync.WaitGroup
+	if outputFile != "" {
+		if err := startOutput(); err != nil {
+			fatal("opening output file failed", "file", outputFile, "err", err)
 		}
-	}()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runOutput(ctx)
+		}()
+	}
+	if len(peers) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runFederation(ctx)
+		}()
+	}
+	if pushURL != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runPush(ctx)
+		}()
+	}
+	if influxURL != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runInflux(ctx)
+		}()
+	}
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t pollTarget) {
+			defer wg.Done()
+			pollData(ctx, t)
+		}(t)
+	}
 
-	for _, mac := range flag.Args() {
-		go pollData(mac)
+	if replayed != nil {
+		replay(replayed)
 	}
 
-	ctx := ble.WithSigHandler(context.Background(), nil)
+	var scanners sync.WaitGroup
+	for i, id := range deviceIDs {
+		scanners.Add(1)
+		go func(i, id int) {
+			defer scanners.Done()
+			devices[i] = scanLoop(ctx, devices[i], id, *scanRetries, vendorFilter(*vendorPrefix))
+		}(i, id)
+	}
+	scanners.Wait()
+	if noScan {
+		<-ctx.Done()
+	}
 
-	telinkVendorFilter := func(a ble.Advertisement) bool {
-		return strings.HasPrefix(a.Addr().String(), TelinkVendorPrefix)
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Error("shutting down HTTP server failed", "err", err)
 	}
-	err = ble.Scan(ctx, true, advHandler, telinkVendorFilter)
-	if err != nil {
-		log.Fatal("oops: %s", err)
+	wg.Wait()
+	if *stateFile != "" {
+		if err := saveState(*stateFile); err != nil {
+			logger.Error("saving state failed", "file", *stateFile, "err", err)
+		}
+	}
+	stopMQTT()
+	for _, device := range devices {
+		device.Stop()
 	}
 }
@@ -0,0 +1,629 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-ble/ble"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMain(m *testing.M) {
+	initMetrics(prometheus.NewRegistry(), "thermometer")
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	os.Exit(m.Run())
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// MiBeacon v5 frames of a LYWSD03MMC (product id 0x055b) with MAC
+// A4C1380283F4, encrypted with testKey by an AES-CCM implementation
+// independent of the one used by the exporter.
+const (
+	testMac  = "A4C1380283F4"
+	testKey  = "8d2a9f0c41b7e35a6d10c2f4b9e8a713"
+	testTemp = "58585b054af4830238c1a46dcda30ced010000b28ddabd" // 0x1004 21.5°C
+	testHum  = "58585b054bf4830238c1a4bfd39692710200006f15d9b6" // 0x1006 48.3%
+	testBatt = "58585b054cf4830238c1a45542189e0300001513084b"   // 0x100a 87%
+	testNeg  = "58585b054ef4830238c1a4f7de247a850500004dee5520" // 0x1004 -2.0°C
+)
+
+func Test_decodeMiBeaconData(t *testing.T) {
+	tests := []struct {
+		name     string
+		frame    string
+		frameMac string
+		key      string // none if empty
+		want     sensorData
+		wantErr  error
+	}{
+		{
+			name:     "temperature",
+			frame:    testTemp,
+			frameMac: testMac,
+			key:      testKey,
+			want:     sensorData{fields: fieldTemp, temp: 21.5},
+		},
+		{
+			name:     "humidity",
+			frame:    testHum,
+			frameMac: testMac,
+			key:      testKey,
+			want:     sensorData{fields: fieldHum, hum: 48.3},
+		},
+		{
+			name:     "battery",
+			frame:    testBatt,
+			frameMac: testMac,
+			key:      testKey,
+			want:     sensorData{fields: fieldBatp, batp: 87},
+		},
+		{
+			name:     "negative temperature",
+			frame:    testNeg,
+			frameMac: testMac,
+			key:      testKey,
+			want:     sensorData{fields: fieldTemp, temp: -2},
+		},
+		{
+			name:     "wrong key",
+			frame:    testTemp,
+			frameMac: testMac,
+			key:      "00112233445566778899aabbccddeeff",
+			wantErr:  errDecrypt,
+		},
+		{
+			name:     "no key",
+			frame:    testTemp,
+			frameMac: testMac,
+			wantErr:  errNoKey,
+		},
+		{
+			name:     "MAC mismatch",
+			frame:    testTemp,
+			frameMac: "A4C1380283F5",
+			key:      testKey,
+			wantErr:  errMacMismatch,
+		},
+		{
+			name:     "missing byte",
+			frame:    testTemp[:len(testTemp)-2],
+			frameMac: testMac,
+			key:      testKey,
+			wantErr:  errDecrypt,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := map[string][]byte{}
+			if tt.key != "" {
+				keys[testMac] = mustHex(t, tt.key)
+			}
+			decryptionKeys.Set(keys)
+
+			sd, err := decodeMiBeaconData(mustHex(t, tt.frame), tt.frameMac)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sd.mac != testMac || sd.format != "stock" {
+				t.Errorf("got mac %s format %s", sd.mac, sd.format)
+			}
+			if sd.fields&fieldNonce == 0 {
+				t.Errorf("counter not decoded")
+			}
+			sd.fields &^= fieldNonce | fieldFrame
+			if sd.fields != tt.want.fields || sd.temp != tt.want.temp ||
+				sd.hum != tt.want.hum || sd.batp != tt.want.batp {
+				t.Errorf("got %+v, want %+v", sd, tt.want)
+			}
+		})
+	}
+}
+
+func Test_decodeMiBeaconDataTruncated(t *testing.T) {
+	decryptionKeys.Set(map[string][]byte{testMac: mustHex(t, testKey)})
+	frame := mustHex(t, testTemp)
+	for n := 0; n < len(frame); n++ {
+		if _, err := decodeMiBeaconData(frame[:n], testMac); err == nil {
+			t.Errorf("no error for frame of length %d", n)
+		}
+	}
+}
+
+func Test_decodeMiBeaconDataCombined(t *testing.T) {
+	decryptionKeys.Set(map[string][]byte{testMac: mustHex(t, testKey)})
+	tests := []struct {
+		name  string
+		frame string
+	}{
+		{"encrypted", "58585b054df4830238c1a415aecf846ca10f0400003bf5a5a1"},
+		{"unencrypted", "50505b054ff4830238c1a40d1004d700e301"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sd, err := decodeMiBeaconData(mustHex(t, tt.frame), testMac)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sd.fields&(fieldTemp|fieldHum) != fieldTemp|fieldHum ||
+				sd.temp != 21.5 || sd.hum != 48.3 {
+				t.Errorf("got %+v, want 21.5°C 48.3%%", sd)
+			}
+		})
+	}
+}
+
+// ATC frame of A4C138FFFFFF: 25.9 (raw 259), 53%, 91%, 2.95V, frame 1
+const testATC = "a4c138ffffff0103355b0b8601"
+
+func Test_tempScale(t *testing.T) {
+	defer delete(tempDivisors, "A4C138FFFFFF")
+
+	var f tempScaleFlag
+	for _, s := range []string{"A4C138FFFFFF", "A4C138FFFFFF=0", "A4C138FFFFFF=0.3", "A4C138FFFFFF=2"} {
+		if err := f.Set(s); err == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+	if err := f.Set("A4:C1:38:FF:FF:FF=0.05"); err != nil {
+		t.Fatal(err)
+	}
+	if d := tempDivisors["A4C138FFFFFF"]; d != 20 {
+		t.Fatalf("got divisor %v, want 20", d)
+	}
+
+	sd, err := decodeATCData(mustHex(t, testATC), "A4C138FFFFFF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sd.temp != 12.95 {
+		t.Errorf("got %v°C, want 12.95", sd.temp)
+	}
+
+	delete(tempDivisors, "A4C138FFFFFF")
+	sd, err = decodeATCData(mustHex(t, testATC), "A4C138FFFFFF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sd.temp != 25.9 {
+		t.Errorf("got %v°C, want 25.9 by default", sd.temp)
+	}
+}
+
+func Test_decodeThermobeaconData(t *testing.T) {
+	// built from the documented layout: company ID 0x0010, flags,
+	// reverse MAC, mV, temperature and humidity in 1/16, uptime
+	tests := []struct {
+		name  string
+		frame string
+		temp  float64
+	}{
+		{"positive", "10000000665544332211860b5801000310270000", 21.5},
+		{"negative", "10000000665544332211860be0ff000310270000", -2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := mustHex(t, tt.frame)
+			if !isThermobeacon(data) {
+				t.Fatal("not recognized")
+			}
+			sd, err := decodeThermobeaconData(data, "112233445566")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sd.temp != tt.temp || sd.hum != 48 || sd.batv != 2.95 {
+				t.Errorf("got %+v, want %v°C 48%% 2.95V", sd, tt.temp)
+			}
+		})
+	}
+
+	_, err := decodeThermobeaconData(mustHex(t, tests[0].frame), "665544332211")
+	if !errors.Is(err, errMacMismatch) {
+		t.Errorf("got error %v for forward MAC, want %v", err, errMacMismatch)
+	}
+}
+
+func Test_findMac(t *testing.T) {
+	data := mustHex(t, "00a4c1380283f400")
+	tests := []struct {
+		frameMac string
+		want     macOrder
+		wantErr  error
+	}{
+		{"A4C1380283F4", macForward, nil},
+		{"F4830238C1A4", macReverse, nil},
+		{"A4C1380283F5", 0, errMacMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.frameMac, func(t *testing.T) {
+			order, err := findMac(data, 1, tt.frameMac)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && order != tt.want {
+				t.Errorf("got %s, want %s", order, tt.want)
+			}
+		})
+	}
+
+	if _, err := findMac(data, 3, "A4C1380283F4"); err == nil {
+		t.Error("no error for frame too short")
+	}
+}
+
+func Test_decodeATCData(t *testing.T) {
+	tests := []struct {
+		name    string
+		frame   string
+		wantErr error
+	}{
+		{"forward MAC", testATC, nil},
+		{"reverse MAC", "ffffff38c1a40103355b0b8601", nil},
+		{"other MAC", "a4c138fffffe0103355b0b8601", errMacMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sd, err := decodeATCData(mustHex(t, tt.frame), "A4C138FFFFFF")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if sd.mac != "A4C138FFFFFF" {
+				t.Errorf("got mac %s", sd.mac)
+			}
+			if sd.embeddedMac != strings.ToUpper(tt.frame[:12]) {
+				t.Errorf("got embedded mac %s", sd.embeddedMac)
+			}
+			if sd.temp != 25.9 || sd.hum != 53 || sd.batp != 91 || sd.batv != 2.95 || sd.frame != 1 {
+				t.Errorf("got %+v", sd)
+			}
+		})
+	}
+}
+
+func Test_registerFrameFormatSwitch(t *testing.T) {
+	const mac = "A4C138FFFFFF"
+	t.Cleanup(func() { forget(mac) })
+
+	frames := []struct {
+		d      *decoder
+		frame  string
+		format string
+		temp   float64
+	}{
+		{&decoders[0], testATC, "atc", 25.9},
+		// PVVX frame 2: 26.00°C, 53.00%, 2.95V, 91%
+		{&decoders[1], "ffffff38c1a4280ab414860b5b0200", "pvvx", 26},
+		{&decoders[0], "a4c138ffffff0104355b0b8603", "atc", 26},
+	}
+	for _, f := range frames {
+		registerFrame(f.d, mustHex(t, f.frame), mac, "hci0", -60)
+
+		statesLock.Lock()
+		firmware := states[mac].info.firmware
+		statesLock.Unlock()
+		if firmware != f.format {
+			t.Errorf("got firmware %q, want %q", firmware, f.format)
+		}
+		if v := testutil.ToFloat64(tempGauge.WithLabelValues(labelValues(mac)...)); v != f.temp {
+			t.Errorf("%s: got %v°C, want %v", f.format, v, f.temp)
+		}
+	}
+}
+
+// fakeClient is a connection whose methods other than CancelConnection
+// panic, as none should be called for an empty profile.
+type fakeClient struct {
+	ble.Client
+	canceled bool
+}
+
+func (c *fakeClient) CancelConnection() error {
+	c.canceled = true
+	return nil
+}
+
+func Test_pollProfileUnsupported(t *testing.T) {
+	const mac = "A4C1380283F6"
+	t.Cleanup(func() {
+		expire(mac)
+		deviceInfosLock.Lock()
+		delete(deviceInfos, mac)
+		deviceInfosLock.Unlock()
+	})
+
+	client := &fakeClient{}
+	err := pollProfile(context.Background(), client, &ble.Profile{}, mac)
+	if err == nil {
+		t.Fatal("no error for a profile without supported characteristics")
+	}
+	if !client.canceled {
+		t.Error("connection not canceled")
+	}
+}
+
+func Test_decodeStockCharacteristicNegative(t *testing.T) {
+	const mac = "A4C1380283F7"
+	t.Cleanup(func() { forget(mac) })
+
+	decodeStockCharacteristic(mac)([]byte{0x38, 0xff, 0x30, 0x8c, 0x0b})
+	if v := testutil.ToFloat64(tempGauge.WithLabelValues(labelValues(mac)...)); v != -2 {
+		t.Errorf("got %v°C, want -2", v)
+	}
+}
+
+func Test_parseKeyLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		wantName string
+		wantErr  bool
+	}{
+		{"single token", "A4C138FFFFFF", "", true},
+		{"whitespace only", " \t ", "", true},
+		{"tabs", "A4C138FFFFFF\t00112233445566778899aabbccddeeff\tBedroom", "Bedroom", false},
+		{"no key", "A4C138FFFFFF - Bedroom", "Bedroom", false},
+		{"invalid MAC", "A4C138FFFF 00112233445566778899aabbccddeeff", "", true},
+		{"short key", "A4C138FFFFFF 0011", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kl, err := parseKeyLine(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && (kl.mac != "A4C138FFFFFF" || kl.name != tt.wantName) {
+				t.Errorf("got %+v", kl)
+			}
+		})
+	}
+}
+
+func Test_loadKeys(t *testing.T) {
+	dir := t.TempDir()
+	file := dir + "/keys"
+	t.Cleanup(func() {
+		os.WriteFile(file, nil, 0600)
+		loadKeys(file)
+	})
+
+	err := os.WriteFile(file, []byte("# sensors\n \t \n"+
+		"A4C1380283F4\t"+testKey+"\tBedroom\n"+
+		"A4C138FFFFFF\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loadKeys(file); err != nil {
+		t.Fatal(err)
+	}
+	if name := sensorName(testMac); name != "Bedroom" {
+		t.Errorf("got name %q, want Bedroom", name)
+	}
+	if _, err := decodeMiBeaconData(mustHex(t, testTemp), testMac); err != nil {
+		t.Errorf("key not loaded: %v", err)
+	}
+	if name := sensorName("A4C138FFFFFF"); name != "A4C138FFFFFF" {
+		t.Errorf("invalid line loaded with name %q", name)
+	}
+}
+
+func Test_shortNotifications(t *testing.T) {
+	const mac = "A4C1380283F8"
+	t.Cleanup(func() { forget(mac) })
+
+	tests := []struct {
+		name   string
+		decode func([]byte, string) (sensorData, error)
+		min    int
+		cb     func([]byte)
+	}{
+		{"stock", decodeStockNotification, 5, decodeStockCharacteristic(mac)},
+		{"temperature", decodeAtcTempNotification, 2, decodeAtcTemp(mac)},
+		{"humidity", decodeAtcHumidityNotification, 2, decodeAtcHumidity(mac)},
+		{"battery", decodeAtcBatteryNotification, 1, decodeAtcBattery(mac)},
+	}
+	payload := []byte{0x38, 0xff, 0x30, 0x8c, 0x0b}
+	for _, d := range tests {
+		t.Run(d.name, func(t *testing.T) {
+			for n := 0; n < d.min; n++ {
+				if _, err := d.decode(payload[:n], mac); !errors.Is(err, errLength) {
+					t.Errorf("length %d: got error %v, want %v", n, err, errLength)
+				}
+				d.cb(payload[:n])
+			}
+			if known(mac) {
+				t.Error("short notification was recorded")
+			}
+		})
+	}
+}
+
+func Test_decodeMiBeaconDataMalformed(t *testing.T) {
+	decryptionKeys.Set(map[string][]byte{testMac: mustHex(t, testKey)})
+	// authentic frames whose decrypted objects are truncated
+	tests := []struct {
+		name  string
+		frame string
+	}{
+		{"object header only", "58585b0551f4830238c1a4e56b0700001d64a85a"},  // 0410
+		{"short value", "58585b0552f4830238c1a4a3213d68080000ae19ef7a"},     // 041002d7
+		{"length past end", "58585b0550f4830238c1a4c77e5462060000fb2a904c"}, // 041005d7
+		{"odd length", "58585b0553f4830238c1a4ad88faff1d0900006dab1185"},    // 04100305d7
+		{"unencrypted", "50505b0554f4830238c1a4041005d7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeMiBeaconData(mustHex(t, tt.frame), testMac)
+			if !errors.Is(err, errLength) {
+				t.Errorf("got error %v, want %v", err, errLength)
+			}
+		})
+	}
+}
+
+func Test_loadKeysConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{dir + "/bedroom", dir + "/kitchen"}
+	for i, name := range []string{"Bedroom", "Kitchen"} {
+		err := os.WriteFile(files[i], []byte(testMac+" "+testKey+" "+name+"\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	empty := dir + "/empty"
+	os.WriteFile(empty, nil, 0600)
+	t.Cleanup(func() {
+		loadKeys(empty)
+		forget(testMac)
+	})
+	if err := loadKeys(files[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// reloads rename the sensor, which expires it while frames arrive
+	frame := mustHex(t, testTemp)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				if err := loadKeys(files[n%2]); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				registerFrame(&decoders[2], frame, testMac, "hci0", -60)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, ok := decryptionKeys.Get(testMac); !ok {
+		t.Error("key lost")
+	}
+}
+
+func Test_decodeMiBeaconDataSleep(t *testing.T) {
+	// 0x1002 is the sleep object, not a voltage
+	sd, err := decodeMiBeaconData(mustHex(t, "50505b0560f4830238c1a40210010c"), testMac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sd.fields&fieldBatv != 0 {
+		t.Errorf("sleep object decoded as %vV", sd.batv)
+	}
+}
+
+func Test_observeInterval(t *testing.T) {
+	const mac = "A4C138FFFFFF"
+	t.Cleanup(func() { forget(mac) })
+
+	interval := func() time.Duration {
+		statesLock.Lock()
+		defer statesLock.Unlock()
+		return states[mac].interval
+	}
+	backdate := func(d time.Duration) {
+		statesLock.Lock()
+		states[mac].lastHeard = time.Now().Add(-d)
+		statesLock.Unlock()
+	}
+
+	registerFrame(&decoders[0], mustHex(t, testATC), mac, "hci0", -60)
+	if d := interval(); d != 0 {
+		t.Fatalf("got interval %v after the first frame", d)
+	}
+
+	// another reception of the same frame, and from a weaker adapter
+	backdate(10 * time.Second)
+	registerFrame(&decoders[0], mustHex(t, testATC), mac, "hci0", -60)
+	registerFrame(&decoders[0], mustHex(t, "a4c138ffffff0104355b0b8602"), mac, "hci1", -90)
+	if d := interval(); d != 0 {
+		t.Fatalf("got interval %v from repeated frames", d)
+	}
+
+	registerFrame(&decoders[0], mustHex(t, "a4c138ffffff0104355b0b8602"), mac, "hci0", -60)
+	if d := interval(); d < 10*time.Second || d > 11*time.Second {
+		t.Errorf("got interval %v, want 10s", d)
+	}
+}
+
+func Test_registerFrameStockFormat(t *testing.T) {
+	decryptionKeys.Set(map[string][]byte{testMac: mustHex(t, testKey)})
+	t.Cleanup(func() { forget(testMac) })
+
+	frames := []string{
+		"50505b054ff4830238c1a40d1004d700e301",               // unencrypted
+		"58585b054df4830238c1a415aecf846ca10f0400003bf5a5a1", // encrypted
+	}
+	for _, frame := range frames {
+		data := mustHex(t, frame)
+		d, _ := findDecoder(XiaomiIncUUID, data)
+		before := testutil.ToFloat64(framesCounter.WithLabelValues(testMac, "stock"))
+		registerFrame(d, data, testMac, "hci0", -60)
+		if n := testutil.ToFloat64(framesCounter.WithLabelValues(testMac, "stock")) - before; n != 1 {
+			t.Errorf("%s: counted %v frames as stock", frame, n)
+		}
+
+		statesLock.Lock()
+		firmware := states[testMac].info.firmware
+		statesLock.Unlock()
+		if firmware != "stock" {
+			t.Errorf("%s: got firmware %q", frame, firmware)
+		}
+	}
+}
+
+func Test_registerFrameLYWSDCGQ(t *testing.T) {
+	const mac = "4C65A8DD7FC1"
+	t.Cleanup(func() { forget(mac) })
+
+	// unencrypted MiBeacon v2 frame of product 0x01aa: 21.5°C 48.3%
+	data := mustHex(t, "5020aa0117c17fdda8654c0d1004d700e301")
+	sd, err := decodeMiBeaconData(data, mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sd.model != "LYWSDCGQ" || sd.format != "stock" || sd.fields&fieldNonce != 0 {
+		t.Errorf("got %+v", sd)
+	}
+
+	d, _ := findDecoder(XiaomiIncUUID, data)
+	registerFrame(d, data, mac, "hci0", -60)
+	if n := testutil.ToFloat64(framesCounter.WithLabelValues(mac, "stock")); n != 1 {
+		t.Errorf("counted %v frames as stock", n)
+	}
+	if v := testutil.ToFloat64(tempGauge.WithLabelValues("LYWSDCGQ", mac, mac)); v != 21.5 {
+		t.Errorf("got %v°C with sensor=LYWSDCGQ, want 21.5", v)
+	}
+}
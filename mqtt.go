@@ -0,0 +1,193 @@
+// lywsd03mmc-exporter - a Prometheus exporter for the LYWSD03MMC BLE thermometer
+
+// Copyright (C) 2020 Leah Neukirchen <leah@vuxu.org>
+// Licensed under the terms of the MIT license, see LICENSE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var mqttClient mqtt.Client
+var mqttPrefix = "lywsd03mmc"
+
+// set by -mqtt-client-id, defaults to lywsd03mmc-exporter-<hostname>
+var mqttClientID string
+
+// with mqttDiscovery, Home Assistant discovery configs are published
+// for each quantity of a sensor; with mqttDiscoveryRemove, they are
+// removed again when the sensor expires
+var mqttDiscovery bool
+var mqttDiscoveryRemove bool
+var mqttDiscoveryPrefix = "homeassistant"
+
+// quantities announced per MAC, to be republished on reconnect
+var announced = make(map[string]map[string]bool)
+var announcedLock sync.Mutex
+
+type mqttReading struct {
+	Value     float64 `json:"value"`
+	Name      string  `json:"name"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+// mqttAvailability is the retained topic telling whether the exporter
+// is online, with "offline" published as last will.
+func mqttAvailability() string {
+	return mqttPrefix + "/status"
+}
+
+func startMQTT(broker, user, pass string) {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(broker)
+	clientID := mqttClientID
+	if clientID == "" {
+		hostname, _ := os.Hostname()
+		clientID = "lywsd03mmc-exporter-" + hostname
+	}
+	opts.SetClientID(clientID)
+	opts.SetUsername(user)
+	opts.SetPassword(pass)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetWill(mqttAvailability(), "offline", 1, true)
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		logger.Info("connected to MQTT broker", "broker", broker)
+		c.Publish(mqttAvailability(), 1, true, "online")
+		if mqttDiscovery {
+			announcedLock.Lock()
+			for mac, quantities := range announced {
+				for quantity := range quantities {
+					publishDiscovery(mac, quantity)
+				}
+			}
+			announcedLock.Unlock()
+		}
+	})
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		logger.Error("lost connection to MQTT broker", "err", err)
+	})
+
+	mqttClient = mqtt.NewClient(opts)
+	// with SetConnectRetry, this keeps trying in the background
+	mqttClient.Connect()
+}
+
+func stopMQTT() {
+	if mqttClient == nil {
+		return
+	}
+	mqttClient.Publish(mqttAvailability(), 1, true, "offline").WaitTimeout(time.Second)
+	mqttClient.Disconnect(250)
+}
+
+func mqttPublish(mac, quantity string, value float64) {
+	if mqttDiscovery {
+		announcedLock.Lock()
+		if announced[mac] == nil {
+			announced[mac] = make(map[string]bool)
+		}
+		if !announced[mac][quantity] {
+			announced[mac][quantity] = true
+			publishDiscovery(mac, quantity)
+		}
+		announcedLock.Unlock()
+	}
+
+	payload, err := json.Marshal(mqttReading{
+		Value:     value,
+		Name:      sensorName(mac),
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		logger.Error("encoding MQTT payload failed", "err", err)
+		return
+	}
+	mqttClient.Publish(mqttPrefix+"/"+mac+"/"+quantity, 0, false, payload)
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Model        string   `json:"model"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+}
+
+type haConfig struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	ValueTemplate     string   `json:"value_template"`
+	DeviceClass       string   `json:"device_class"`
+	StateClass        string   `json:"state_class"`
+	UnitOfMeasurement string   `json:"unit_of_measurement"`
+	AvailabilityTopic string   `json:"availability_topic"`
+	Device            haDevice `json:"device"`
+}
+
+var haQuantities = map[string]struct{ name, class, unit string }{
+	"temperature": {"Temperature", "temperature", "°C"},
+	"humidity":    {"Humidity", "humidity", "%"},
+	"battery":     {"Battery", "battery", "%"},
+	"voltage":     {"Battery voltage", "voltage", "V"},
+}
+
+func discoveryTopic(mac, quantity string) string {
+	return fmt.Sprintf("%s/sensor/%s_%s/config", mqttDiscoveryPrefix, mac, quantity)
+}
+
+// publishDiscovery publishes the retained Home Assistant discovery
+// config for quantity of mac.  All quantities of a MAC share one
+// device.
+func publishDiscovery(mac, quantity string) {
+	q, ok := haQuantities[quantity]
+	if !ok {
+		return
+	}
+
+	model := sensorModel(mac)
+
+	payload, err := json.Marshal(haConfig{
+		Name:              q.name,
+		UniqueID:          mac + "_" + quantity,
+		StateTopic:        mqttPrefix + "/" + mac + "/" + quantity,
+		ValueTemplate:     "{{ value_json.value }}",
+		DeviceClass:       q.class,
+		StateClass:        "measurement",
+		UnitOfMeasurement: q.unit,
+		AvailabilityTopic: mqttAvailability(),
+		Device: haDevice{
+			Identifiers: []string{"lywsd03mmc_" + mac},
+			Name:        sensorName(mac),
+			Model:       model,
+		},
+	})
+	if err != nil {
+		logger.Error("encoding MQTT payload failed", "err", err)
+		return
+	}
+	mqttClient.Publish(discoveryTopic(mac, quantity), 1, true, payload)
+}
+
+// mqttExpire forgets the discovery configs of mac, and removes them
+// from Home Assistant with mqttDiscoveryRemove.
+func mqttExpire(mac string) {
+	announcedLock.Lock()
+	quantities := announced[mac]
+	delete(announced, mac)
+	announcedLock.Unlock()
+
+	if !mqttDiscoveryRemove {
+		return
+	}
+	for quantity := range quantities {
+		mqttClient.Publish(discoveryTopic(mac, quantity), 1, true, "")
+	}
+}
@@ -0,0 +1,181 @@
+// lywsd03mmc-exporter - a Prometheus exporter for the LYWSD03MMC BLE thermometer
+
+// Copyright (C) 2020 Leah Neukirchen <leah@vuxu.org>
+// Licensed under the terms of the MIT license, see LICENSE.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// set by -output-file, -output-format and -output-max-size
+var outputFile string
+var outputFormat = "csv"
+var outputMaxSize int64 = 10 << 20
+
+var csvHeader = []string{"time", "mac", "name", "temperature", "humidity", "battery", "voltage", "rssi"}
+
+type outputRow struct {
+	Time        string   `json:"time"`
+	MAC         string   `json:"mac"`
+	Name        string   `json:"name"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	Humidity    *float64 `json:"humidity,omitempty"`
+	Battery     *float64 `json:"battery,omitempty"`
+	Voltage     *float64 `json:"voltage,omitempty"`
+	RSSI        *int     `json:"rssi,omitempty"`
+}
+
+var output struct {
+	sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+// openOutput opens outputFile for appending.  output must be locked.
+func openOutput() error {
+	f, err := os.OpenFile(outputFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	output.file = f
+	output.w = bufio.NewWriter(f)
+	output.size = fi.Size()
+	if output.size == 0 && outputFormat == "csv" {
+		output.size += writeCSV(csvHeader)
+	}
+	return nil
+}
+
+// rotateOutput moves outputFile to outputFile.1 and starts a new one.
+// output must be locked.
+func rotateOutput() error {
+	output.w.Flush()
+	output.file.Close()
+	if err := os.Rename(outputFile, outputFile+".1"); err != nil {
+		return err
+	}
+	return openOutput()
+}
+
+func writeCSV(record []string) int64 {
+	cw := csv.NewWriter(output.w)
+	cw.Write(record)
+	cw.Flush()
+	n := 0
+	for _, f := range record {
+		n += len(f) + 1
+	}
+	return int64(n)
+}
+
+func formatValue(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*v, 'f', -1, 64)
+}
+
+// outputRecord appends a row with the reading of quantity to the
+// output file, rotating it when it reaches outputMaxSize.
+func outputRecord(mac, quantity string, value float64) {
+	row := outputRow{
+		Time: time.Now().UTC().Format(time.RFC3339),
+		MAC:  mac,
+		Name: sensorName(mac),
+	}
+	switch quantity {
+	case "temperature":
+		row.Temperature = &value
+	case "humidity":
+		row.Humidity = &value
+	case "battery":
+		row.Battery = &value
+	case "voltage":
+		row.Voltage = &value
+	}
+	statesLock.Lock()
+	if st, ok := states[mac]; ok && st.hasRSSI {
+		rssi := st.rssi
+		row.RSSI = &rssi
+	}
+	statesLock.Unlock()
+
+	output.Lock()
+	defer output.Unlock()
+	if output.w == nil {
+		return
+	}
+
+	if outputFormat == "ndjson" {
+		line, _ := json.Marshal(row)
+		output.w.Write(append(line, '\n'))
+		output.size += int64(len(line) + 1)
+	} else {
+		rssi := ""
+		if row.RSSI != nil {
+			rssi = strconv.Itoa(*row.RSSI)
+		}
+		output.size += writeCSV([]string{row.Time, row.MAC, row.Name,
+			formatValue(row.Temperature), formatValue(row.Humidity),
+			formatValue(row.Battery), formatValue(row.Voltage), rssi})
+	}
+
+	if outputMaxSize > 0 && output.size >= outputMaxSize {
+		if err := rotateOutput(); err != nil {
+			logger.Error("rotating output file failed", "file", outputFile, "err", err)
+			output.w = nil
+		}
+	}
+}
+
+// startOutput opens the output file.
+func startOutput() error {
+	if outputFormat != "csv" && outputFormat != "ndjson" {
+		return fmt.Errorf("unknown output format %q", outputFormat)
+	}
+	output.Lock()
+	defer output.Unlock()
+	return openOutput()
+}
+
+// runOutput flushes the output file every 10 seconds until ctx is
+// done, then closes it.
+func runOutput(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			output.Lock()
+			if output.w != nil {
+				output.w.Flush()
+				output.file.Close()
+				output.w = nil
+			}
+			output.Unlock()
+			return
+		case <-ticker.C:
+			output.Lock()
+			if output.w != nil {
+				output.w.Flush()
+			}
+			output.Unlock()
+		}
+	}
+}
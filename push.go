@@ -0,0 +1,46 @@
+// lywsd03mmc-exporter - a Prometheus exporter for the LYWSD03MMC BLE thermometer
+
+// Copyright (C) 2020 Leah Neukirchen <leah@vuxu.org>
+// Licensed under the terms of the MIT license, see LICENSE.
+
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// push settings, set by -pushgateway-url, -push-interval, -push-job and
+// -push-instance
+var pushURL string
+var pushInterval = 15 * time.Second
+var pushJob = "lywsd03mmc-exporter"
+var pushInstance string
+
+// runPush pushes all metrics to the Pushgateway every pushInterval
+// until ctx is done.  Failed pushes are retried on the next interval.
+func runPush(ctx context.Context) {
+	instance := pushInstance
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	pusher := push.New(pushURL, pushJob).
+		Gatherer(registry).
+		Grouping("instance", instance)
+
+	ticker := time.NewTicker(pushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := pusher.Push(); err != nil {
+				logger.Error("pushing to Pushgateway failed", "url", pushURL, "err", err)
+			}
+		}
+	}
+}
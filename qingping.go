@@ -0,0 +1,63 @@
+// lywsd03mmc-exporter - a Prometheus exporter for the LYWSD03MMC BLE thermometer
+
+// Copyright (C) 2020 Leah Neukirchen <leah@vuxu.org>
+// Licensed under the terms of the MIT license, see LICENSE.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/go-ble/ble"
+)
+
+// Qingping (CGG1, CGDK2, ...) service data: frame control, device
+// type, reverse MAC, then objects of id, length and value.
+
+var QingpingUUID = ble.UUID16(0xfdcd)
+
+func decodeQingpingData(data []byte, frameMac string) (sensorData, error) {
+	if err := expectMac(data, 2, frameMac, macReverse); err != nil {
+		return sensorData{}, err
+	}
+
+	sd := sensorData{
+		mac:         frameMac,
+		embeddedMac: payloadMac(data, 2),
+		format:      "qingping",
+		model:       "Qingping",
+	}
+
+	data = data[8:]
+	for len(data) > 0 {
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return sensorData{}, fmt.Errorf("%w: truncated object", errLength)
+		}
+		id := data[0]
+		v := data[2 : 2+int(data[1])]
+		data = data[2+len(v):]
+
+		switch {
+		case id == 0x01 && len(v) >= 4: // temperature, humidity, 0.1 units
+			sd.temp = float64(int16(binary.LittleEndian.Uint16(v[0:2]))) / tempDivisor(frameMac, 10)
+			sd.hum = float64(binary.LittleEndian.Uint16(v[2:4])) / 10.0
+			sd.fields |= fieldTemp | fieldHum
+		case id == 0x02 && len(v) >= 1: // battery, %
+			sd.batp = float64(v[0])
+			sd.fields |= fieldBatp
+		}
+	}
+
+	return sd, nil
+}
+
+// hasQingpingData reports whether a carries Qingping service data.
+func hasQingpingData(a ble.Advertisement) bool {
+	for _, sd := range a.ServiceData() {
+		if sd.UUID.Equal(QingpingUUID) {
+			return true
+		}
+	}
+	return false
+}
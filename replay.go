@@ -0,0 +1,109 @@
+// lywsd03mmc-exporter - a Prometheus exporter for the LYWSD03MMC BLE thermometer
+
+// Copyright (C) 2020 Leah Neukirchen <leah@vuxu.org>
+// Licensed under the terms of the MIT license, see LICENSE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-ble/ble"
+)
+
+// replayAdv is a recorded advertisement, implementing ble.Advertisement.
+type replayAdv struct {
+	addr        ble.Addr
+	rssi        int
+	serviceData []ble.ServiceData
+	mfData      []byte
+}
+
+func (a *replayAdv) LocalName() string              { return "" }
+func (a *replayAdv) ManufacturerData() []byte       { return a.mfData }
+func (a *replayAdv) ServiceData() []ble.ServiceData { return a.serviceData }
+func (a *replayAdv) Services() []ble.UUID           { return nil }
+func (a *replayAdv) OverflowService() []ble.UUID    { return nil }
+func (a *replayAdv) TxPowerLevel() int              { return 0 }
+func (a *replayAdv) Connectable() bool              { return false }
+func (a *replayAdv) SolicitedService() []ble.UUID   { return nil }
+func (a *replayAdv) RSSI() int                      { return a.rssi }
+func (a *replayAdv) Addr() ble.Addr                 { return a.addr }
+
+// parseReplayLine parses MAC RSSI FRAME..., where each FRAME is
+// UUID:HEX for service data or manufacturer:HEX, as logged for
+// advertisements that crash the decoder.
+func parseReplayLine(line string) (*replayAdv, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("expected MAC RSSI FRAME...")
+	}
+	mac := macWithoutColons(fields[0])
+	if len(mac) != 12 {
+		return nil, fmt.Errorf("invalid MAC %q", fields[0])
+	}
+	rssi, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid RSSI %q", fields[1])
+	}
+
+	a := &replayAdv{addr: ble.NewAddr(mac), rssi: rssi}
+	for _, frame := range fields[2:] {
+		kind, data, ok := strings.Cut(frame, ":")
+		if !ok {
+			return nil, fmt.Errorf("expected UUID:HEX, got %q", frame)
+		}
+		b, err := hex.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data %q: %s", data, err)
+		}
+		if kind == "manufacturer" {
+			a.mfData = b
+			continue
+		}
+		uuid, err := ble.Parse(kind)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UUID %q: %s", kind, err)
+		}
+		a.serviceData = append(a.serviceData, ble.ServiceData{UUID: uuid, Data: b})
+	}
+	return a, nil
+}
+
+// loadReplay reads the advertisements to replay from filename, one
+// per line, skipping empty lines and comments.
+func loadReplay(filename string) ([]*replayAdv, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var advs []*replayAdv
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		a, err := parseReplayLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, n, err)
+		}
+		advs = append(advs, a)
+	}
+	return advs, scanner.Err()
+}
+
+// replay passes the recorded advertisements to advHandler, in order.
+func replay(advs []*replayAdv) {
+	for _, a := range advs {
+		advHandler(a, "replay")
+	}
+	logger.Info("replayed advertisements", "count", len(advs))
+}
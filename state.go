@@ -0,0 +1,139 @@
+// lywsd03mmc-exporter - a Prometheus exporter for the LYWSD03MMC BLE thermometer
+
+// Copyright (C) 2020 Leah Neukirchen <leah@vuxu.org>
+// Licensed under the terms of the MIT license, see LICENSE.
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"time"
+)
+
+// savedSensor is the last state of a sensor in the -state-file.
+type savedSensor struct {
+	Format   string             `json:"format"`
+	Model    string             `json:"model"`
+	LastSeen int64              `json:"last_seen"`
+	Readings map[string]float64 `json:"readings"`
+}
+
+// saveState writes the last readings of all live sensors to filename.
+func saveState(filename string) error {
+	saved := make(map[string]savedSensor)
+
+	statesLock.Lock()
+	for mac, st := range states {
+		if !known(mac) || len(st.readings) == 0 {
+			continue
+		}
+		readings := make(map[string]float64)
+		for quantity, v := range st.readings {
+			readings[quantity] = v
+		}
+		saved[mac] = savedSensor{
+			Format:   st.info.firmware,
+			Model:    st.info.model,
+			LastSeen: st.lastSeen.Unix(),
+			Readings: readings,
+		}
+	}
+	statesLock.Unlock()
+
+	data, err := json.MarshalIndent(saved, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// loadState restores the metrics of the sensors in filename, which
+// expire when they aren't seen again within their expiry time after
+// the saved reading.  A missing or corrupt file is skipped.
+func loadState(filename string) {
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		logger.Warn("reading state file failed", "file", filename, "err", err)
+		return
+	}
+
+	var saved map[string]savedSensor
+	if err := json.Unmarshal(data, &saved); err != nil {
+		logger.Warn("parsing state file failed", "file", filename, "err", err)
+		return
+	}
+
+	restored := 0
+	for mac, s := range saved {
+		expiry := expiryAdv
+		if s.Format == "stock" {
+			expiry = expiryStock
+		}
+		expiry -= time.Since(time.Unix(s.LastSeen, 0))
+		if expiry <= 0 || len(mac) != 12 {
+			continue
+		}
+
+		identify(sensorData{mac: mac, format: s.Format, model: s.Model})
+		bump(mac, expiry)
+		statesLock.Lock()
+		st := sensor(mac)
+		st.lastSeen = time.Unix(s.LastSeen, 0)
+		// the downtime is no advertising interval
+		st.lastHeard, st.interval = time.Time{}, 0
+		statesLock.Unlock()
+		lastSeenGauge.WithLabelValues(labelValues(mac)...).Set(float64(s.LastSeen))
+		for quantity, v := range s.Readings {
+			restoreReading(mac, quantity, v)
+		}
+		logDerived(mac)
+		restored++
+	}
+	logger.Info("restored state", "file", filename, "sensors", restored)
+}
+
+// restoreReading exports a saved reading as is, bypassing
+// calibration and smoothing, which were applied before saving.
+func restoreReading(mac, quantity string, v float64) {
+	statesLock.Lock()
+	st := sensor(mac)
+	st.readings[quantity] = v
+	switch quantity {
+	case "temperature":
+		st.temp, st.hasTemp = v, true
+	case "humidity":
+		st.hum, st.hasHum = v, true
+	}
+	statesLock.Unlock()
+
+	labels := labelValues(mac)
+	switch quantity {
+	case "temperature":
+		tempGauge.WithLabelValues(labels...).Set(v)
+		if exportFahrenheit {
+			fahrenheitGauge.WithLabelValues(labels...).Set(v*9/5 + 32)
+		}
+		if exportMilli {
+			milliTempGauge.WithLabelValues(labels...).Set(math.Round(v * 1000))
+		}
+	case "humidity":
+		humGauge.WithLabelValues(labels...).Set(v)
+		if exportMilli {
+			milliHumGauge.WithLabelValues(labels...).Set(math.Round(v * 1000))
+		}
+	case "battery":
+		battGauge.WithLabelValues(labels...).Set(v)
+	case "voltage":
+		voltGauge.WithLabelValues(labels...).Set(v)
+	}
+}
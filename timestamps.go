@@ -0,0 +1,74 @@
+// lywsd03mmc-exporter - a Prometheus exporter for the LYWSD03MMC BLE thermometer
+
+// Copyright (C) 2020 Leah Neukirchen <leah@vuxu.org>
+// Licensed under the terms of the MIT license, see LICENSE.
+
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// timestampRegisterer registers collectors whose per-sensor samples
+// carry the time the sensor was last seen, with -timestamps.
+type timestampRegisterer struct {
+	prometheus.Registerer
+}
+
+func (r timestampRegisterer) Register(c prometheus.Collector) error {
+	return r.Registerer.Register(timestamped{c})
+}
+
+func (r timestampRegisterer) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (r timestampRegisterer) Unregister(c prometheus.Collector) bool {
+	return r.Registerer.Unregister(timestamped{c})
+}
+
+// timestamped adds the last seen time of the sensor in the mac label
+// to the samples of a collector.
+type timestamped struct {
+	prometheus.Collector
+}
+
+func (t timestamped) Collect(ch chan<- prometheus.Metric) {
+	seen := make(map[string]time.Time)
+	statesLock.Lock()
+	for mac, st := range states {
+		if !st.lastSeen.IsZero() {
+			seen[mac] = st.lastSeen
+		}
+	}
+	statesLock.Unlock()
+
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		t.Collector.Collect(metrics)
+		close(metrics)
+	}()
+
+	for m := range metrics {
+		var pb dto.Metric
+		if err := m.Write(&pb); err == nil {
+			for _, l := range pb.Label {
+				if l.GetName() != "mac" {
+					continue
+				}
+				if ts, ok := seen[l.GetValue()]; ok {
+					m = prometheus.NewMetricWithTimestamp(ts, m)
+				}
+				break
+			}
+		}
+		ch <- m
+	}
+}